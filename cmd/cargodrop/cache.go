@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/cli"
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+	"github.com/cosmiclabstudio/cargodrop/internal/workers"
+)
+
+// runCacheCommand handles "cargodrop cache <command>" and returns the exit code
+func runCacheCommand(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Path to config file, for the cache dir and max size")
+	maxSize := fs.String("max-size", "", "Shrink the cache down to this size instead of the configured one, e.g. 2GB")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(fs.Output(), "Usage: cargodrop cache gc [flags]")
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 || args[0] != "gc" {
+		fs.Usage()
+		return exitUsage
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	term := cli.NewTerminal()
+	defer term.Finish()
+
+	// the cache is shared, so it works without a config as well
+	config := &parsers.Config{Cache: parsers.CacheConfig{MaxSize: parsers.DefaultCacheMaxSize}}
+	if *configPath != "" {
+		loaded, err := parsers.LoadConfig(*configPath)
+		if err != nil {
+			utils.LogError(err)
+			return exitUsage
+		}
+		config = loaded
+	}
+	if *maxSize != "" {
+		config.Cache.MaxSize = *maxSize
+	}
+
+	if err := workers.GarbageCollectCache(config); err != nil {
+		utils.LogError(err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/cli"
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// runKeygenCommand handles "cargodrop keygen", it creates a signing key pair and returns the exit code
+func runKeygenCommand(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	out := fs.String("out", "cargodrop.key", "Where to write the private key, it must not exist yet")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(fs.Output(), "Usage: cargodrop keygen [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	term := cli.NewTerminal()
+	defer term.Finish()
+
+	public, err := parsers.GenerateKeyPair(*out)
+	if err != nil {
+		utils.LogError(err)
+		return exitFailure
+	}
+
+	utils.LogMessage("Private key written to " + *out + ", set it as signing_key in the server config and keep it secret.")
+	utils.LogMessage("Add the public key to trusted_keys in the config you hand out to players:")
+	// the public key goes to stdout so it can be piped into a file
+	fmt.Println(public)
+	return exitOK
+}
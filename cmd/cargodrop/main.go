@@ -3,33 +3,142 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"fyne.io/fyne/v2/app"
+	"github.com/cosmiclabstudio/cargodrop/internal/cli"
 	"github.com/cosmiclabstudio/cargodrop/internal/gui"
 	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
 	"github.com/cosmiclabstudio/cargodrop/internal/utils"
 	"github.com/cosmiclabstudio/cargodrop/internal/workers"
 )
 
+// Exit codes, so launchers and scripts can tell what happened
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	// exitUpdateAvailable is returned by --plan when an update would change files
+	exitUpdateAvailable = 3
+	// exitBroken is returned by --verify and --repair when tracked files are still missing or modified
+	exitBroken = 4
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == workers.SelfTestArg {
+		// a self-update checks that the new build starts before it swaps it in
+		fmt.Println(utils.Version)
+		os.Exit(exitOK)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCacheCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		os.Exit(runKeygenCommand(os.Args[2:]))
+	}
+
 	baseDir := flag.String("base-dir", ".", "The directory containing the base files")
 	configPath := flag.String("config", "", "Path to config file")
 	resourcesPath := flag.String("resources", "", "Path to resources file")
 	isGenResource := flag.Bool("generate-metadata", false, "Whether to generate metadata for server")
 	isServiceModrinth := flag.Bool("modrinth", false, "Use Modrinth to add download links")
+	isFullVerify := flag.Bool("full-verify", false, "Hash every file again instead of trusting the local hash index")
+	limitRate := flag.String("limit-rate", "", "Limit the total download speed, e.g. 2MB (per second)")
+	limitConnectionRate := flag.String("limit-connection-rate", "", "Limit the speed of every single download, e.g. 512K (per second)")
+	isHeadless := flag.Bool("headless", false, "Run in the terminal without a window (default when no display is available)")
+	isPlan := flag.Bool("plan", false, "Only show what an update would do, exits with 3 when an update is available")
+	planFormat := flag.String("plan-format", cli.PlanFormatText, "Output format of --plan: text or json")
+	isVerify := flag.Bool("verify", false, "Hash every installed file and report missing, modified and extra files")
+	isRepair := flag.Bool("repair", false, "Like --verify, but download missing and modified files again")
+	side := flag.String("side", parsers.SideClient, "Which side to install for: client, server or both")
+	groupList := flag.String("groups", "", "Comma separated optional groups to install instead of the saved choice, empty installs none")
+	noSelfUpdate := flag.Bool("no-self-update", false, "Do not update cargodrop itself when the pack asks for a newer version")
+	noLaunch := flag.Bool("no-launch", false, "Do not run the launch command of the config after updating")
 	flag.Parse()
 
+	// nil keeps the player's saved choice, only an explicit --groups replaces it
+	var groups []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "groups" {
+			groups = splitList(*groupList)
+		}
+	})
+
+	// No window without a display, dedicated servers and containers get the terminal instead
+	headless := *isHeadless || *isPlan || !cli.HasDisplay()
+	var term *cli.Terminal
+	if headless {
+		term = cli.NewTerminal()
+	}
+
+	_ = utils.InitializeLog()
+
+	// A build installed by a self-update that never got as far as reading its config is replaced by the previous one
+	workers.RecoverSelfUpdate()
+
+	if *side != parsers.SideClient && *side != parsers.SideServer && *side != parsers.SideBoth {
+		utils.LogError(fmt.Errorf("unknown side %q, expected %s, %s or %s", *side, parsers.SideClient, parsers.SideServer, parsers.SideBoth))
+		os.Exit(exitUsage)
+	}
+	if *isPlan && *planFormat != cli.PlanFormatText && *planFormat != cli.PlanFormatJSON {
+		utils.LogError(fmt.Errorf("unknown plan format %q, expected %s or %s", *planFormat, cli.PlanFormatText, cli.PlanFormatJSON))
+		os.Exit(exitUsage)
+	}
+
+	// Nothing touches the network or the disk before the config and the resources file were checked
+	var report problemReport
 	config, err := parsers.LoadConfig(*configPath)
 	if err != nil {
-		utils.LogError(err)
-		return
+		report.fail(err)
+		// still enough for a window that shows what is wrong
+		config = &parsers.Config{Name: "CargoDrop"}
+	} else {
+		// Command line limits win over the config file
+		if *limitRate != "" {
+			config.DownloadRateLimit = *limitRate
+		}
+		if *limitConnectionRate != "" {
+			config.ConnectionRateLimit = *limitConnectionRate
+		}
+		report.add(*configPath, config.Validate())
 	}
 	utils.LogMessage("Config file: " + *configPath)
 
 	resources, err := parsers.LoadResource(*resourcesPath)
-	if err != nil {
+	missingResources := err != nil
+	switch {
+	case err == nil:
+		// only the config and the manifest from the server are held to the rules, the local file is what was applied last time
+		problems := resources.Validate()
+		report.warn(*resourcesPath, problems)
+		if problems.HasErrors() && !*isGenResource {
+			report.note(*resourcesPath + " is invalid, treating it as if nothing was applied yet.")
+			resources = nil
+		}
+	case !os.IsNotExist(err) && *isGenResource:
+		// the generator would overwrite whatever is in there
+		report.fail(err)
+	case !os.IsNotExist(err):
+		utils.LogWarning("Unable to read " + *resourcesPath + ", starting over: " + err.Error())
+	}
+
+	// This build started and read its config and manifest, so a self-update that installed it went fine
+	workers.ConfirmSelfUpdate()
+
+	if headless {
+		report.log()
+		if report.failed {
+			term.Finish()
+			os.Exit(exitUsage)
+		}
+	}
+
+	if resources == nil {
 		resources = &parsers.ResourceSet{
+			SchemaVersion:   parsers.CurrentSchemaVersion,
 			Name:            config.Name,
 			LocalVersion:    "1.0.0",
 			ResourceSetHash: "",
@@ -37,35 +146,195 @@ func main() {
 			Resources:       []parsers.Resource{},
 		}
 
-		// Save default resources file
-		err = saveDefaultResourceSet(resources, *resourcesPath)
+		// Save default resources file, a plan does not write anything
+		if missingResources && !*isPlan && !report.failed {
+			err = saveDefaultResourceSet(resources, *resourcesPath)
+			if err != nil {
+				utils.LogError(err)
+				os.Exit(exitFailure)
+			}
+			utils.LogWarning("Missing resource.json! Creating one at " + *resourcesPath)
+		}
+	}
+	utils.LogMessage("Resources file: " + *resourcesPath)
+
+	// The limits of the config and the command line are set once, the window may change them afterwards
+	if !report.failed {
+		if err := workers.ApplyRateLimits(config); err != nil {
+			utils.LogError(err)
+		}
+	}
+
+	updateOpts := workers.UpdateOptions{FullVerify: *isFullVerify, Groups: groups, Side: *side, NoSelfUpdate: *noSelfUpdate}
+	run := func(progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error), backupCb func(string, []string)) int {
+		switch {
+		case *isGenResource:
+			utils.LogMessage("Generating metadata for server...")
+			if err := workers.RunGenSourceSequence(config, resources, *baseDir, *resourcesPath, progressCb, errorCb, *isServiceModrinth); err != nil {
+				return exitFailure
+			}
+		case *isVerify || *isRepair:
+			report, err := workers.RunVerifySequence(config, resources, *baseDir, *isRepair, progressCb, errorCb)
+			if err != nil {
+				return exitFailure
+			}
+			if len(report.BackedUp) > 0 && backupCb != nil {
+				backupCb(report.BackupDir, report.BackedUp)
+			}
+			if report.IsBroken() {
+				return exitBroken
+			}
+		default:
+			opts := updateOpts
+			opts.OnBackup = backupCb
+			if err := workers.RunUpdateSequence(config, resources, *baseDir, *resourcesPath, opts, progressCb, errorCb); err != nil {
+				return exitFailure
+			}
+		}
+		return exitOK
+	}
+
+	// launch runs the launch command of the config when the update ended with code, and reports whether it did
+	launch := func(code int) bool {
+		if config.Launch == nil || *noLaunch || *isGenResource || *isVerify || *isRepair {
+			return false
+		}
+		status := workers.LaunchAfterSuccess
+		if code != exitOK {
+			if !config.Launch.OnFailure {
+				return false
+			}
+			status = workers.LaunchAfterFailure
+		}
+		vars := workers.LaunchVars(config, *baseDir, *resourcesPath, *side, status)
+
+		// the game prints to the terminal, or to its own file when there is only the window
+		stdout, stderr := os.Stdout, os.Stderr
+		if !headless {
+			if logFile, err := os.Create(workers.LaunchLogFile); err != nil {
+				utils.LogWarning("Unable to create " + workers.LaunchLogFile + ", the output of the game is not kept: " + err.Error())
+			} else {
+				defer func() { _ = logFile.Close() }()
+				stdout, stderr = logFile, logFile
+				utils.LogMessage("The output of the game goes to " + workers.LaunchLogFile)
+			}
+		}
+		if _, err := workers.RunLaunchCommand(config.Launch, vars, stdout, stderr); err != nil {
+			utils.LogError(err)
+		}
+		return true
+	}
+
+	if *isPlan {
+		// the plan goes to stdout, logs stay on stderr so the output can be piped
+		summary, err := workers.RunPlanSequence(config, resources, *baseDir, updateOpts, term.HandleError)
+		term.Finish()
 		if err != nil {
+			os.Exit(exitFailure)
+		}
+		if err := cli.PrintPlan(os.Stdout, summary, *planFormat); err != nil {
 			utils.LogError(err)
-			return
+			os.Exit(exitUsage)
+		}
+		if summary.UpdateAvailable {
+			os.Exit(exitUpdateAvailable)
 		}
-		utils.LogWarning("Missing resource.json! Creating one at " + *resourcesPath)
+		os.Exit(exitOK)
+	}
+
+	if headless {
+		code := run(term.UpdateProgress, term.HandleError, nil)
+		term.Finish()
+		launch(code)
+		os.Exit(code)
 	}
-	utils.LogMessage("Resources file: " + *resourcesPath)
 
 	a := app.New()
 	mw := gui.NewMainWindow(a, config, resources)
+	mw.OnRateLimitChanged = workers.SetDownloadRateLimit
+	mw.OnConnectionRateLimitChanged = workers.SetConnectionRateLimit
 
-	err = utils.InitializeLog()
-	if err != nil {
-		return
+	updateOpts.ChooseGroups = mw.ChooseGroups
+	updateOpts.BeforeRestart = mw.Hide
+
+	// The player can change the optional content at any time, a change asked for during an update waits for it
+	changeGroups := make(chan struct{}, 1)
+	mw.OnChangeGroups = func() {
+		select {
+		case changeGroups <- struct{}{}:
+		default:
+		}
 	}
 
 	// Start processing in background goroutine
 	go func() {
-		if *isGenResource {
-			utils.LogMessage("Generating metadata for server...")
-			workers.RunGenSourceSequence(config, resources, *baseDir, *resourcesPath, mw.UpdateProgress, mw.HandleError, *isServiceModrinth)
-		} else {
-			workers.RunUpdateSequence(config, resources, *baseDir, *resourcesPath, mw.UpdateProgress, mw.HandleError)
+		// the window's log only starts now, so this is where the player gets to see the problems
+		report.log()
+		if report.failed {
+			mw.ShowProblems(report.lines())
+			return
+		}
+
+		// only an update installs optional content
+		mw.AllowChangeGroups(!*isGenResource && !*isVerify && !*isRepair)
+		for {
+			backedUp := false
+			code := run(mw.UpdateProgress, mw.HandleError, func(backupDir string, files []string) {
+				backedUp = true
+				mw.ShowBackups(backupDir, files)
+			})
+			select {
+			case <-changeGroups:
+				// apply the new choice before the game starts
+				utils.LogMessage("Changing the optional content...")
+				updateOpts.ChangeGroups = true
+				continue
+			default:
+			}
+
+			// stay open when there is something the player should read first
+			readFirst := code != exitOK || backedUp || *isGenResource || *isVerify || *isRepair
+			if config.Launch != nil && !*noLaunch && !readFirst {
+				mw.Hide()
+			}
+			if launch(code) {
+				// the game may be using the files now
+				mw.AllowChangeGroups(false)
+				if !readFirst {
+					os.Exit(code)
+				}
+				return
+			}
+			if readFirst {
+				<-changeGroups
+			} else {
+				// let the player read the log for a moment, then get out of the way of the game
+				select {
+				case <-changeGroups:
+				case <-time.After(3 * time.Second):
+					os.Exit(exitOK)
+				}
+			}
+			utils.LogMessage("Changing the optional content...")
+			updateOpts.ChangeGroups = true
 		}
 	}()
 
 	mw.Window.ShowAndRun()
+	if report.failed {
+		os.Exit(exitUsage)
+	}
+}
+
+// splitList splits a comma separated flag value, an empty value is an empty list
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
 func saveDefaultResourceSet(resources *parsers.ResourceSet, path string) error {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// problemReport collects what is wrong with the config and the resources file, so all of it can be shown
+// at once before anything is downloaded or written
+type problemReport struct {
+	problems []reportedProblem
+	failed   bool
+}
+
+type reportedProblem struct {
+	line    string
+	isError bool
+}
+
+// fail records a file that could not be read at all
+func (r *problemReport) fail(err error) {
+	r.problems = append(r.problems, reportedProblem{line: err.Error(), isError: true})
+	r.failed = true
+}
+
+// add records the validation problems of file
+func (r *problemReport) add(file string, problems parsers.Problems) {
+	for _, p := range problems {
+		isError := p.Severity == parsers.SeverityError
+		r.problems = append(r.problems, reportedProblem{line: p.Format(file), isError: isError})
+		r.failed = r.failed || isError
+	}
+}
+
+// warn records the problems of a file that is only a hint, as warnings whatever their severity
+func (r *problemReport) warn(file string, problems parsers.Problems) {
+	for _, p := range problems {
+		p.Severity = parsers.SeverityWarning
+		r.problems = append(r.problems, reportedProblem{line: p.Format(file)})
+	}
+}
+
+// note records a warning that is not tied to a field
+func (r *problemReport) note(line string) {
+	r.problems = append(r.problems, reportedProblem{line: line})
+}
+
+// log writes every problem to the log, errors first
+func (r *problemReport) log() {
+	for _, p := range r.problems {
+		if p.isError {
+			utils.LogError(errors.New(p.line))
+		}
+	}
+	for _, p := range r.problems {
+		if !p.isError {
+			utils.LogWarning(p.line)
+		}
+	}
+}
+
+// lines returns every problem for a dialog, errors first
+func (r *problemReport) lines() []string {
+	var errs, warnings []string
+	for _, p := range r.problems {
+		if p.isError {
+			errs = append(errs, p.line)
+		} else {
+			warnings = append(warnings, p.line)
+		}
+	}
+	return append(errs, warnings...)
+}
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"path/filepath"
 
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
 	"github.com/cosmiclabstudio/cargodrop/internal/utils"
 )
 
@@ -31,62 +31,103 @@ type ModrinthVersionResponse struct {
 	Files        []ModrinthVersionFile `json:"files"`
 }
 
-// GetModrinthURL fetches the download URL for a file from Modrinth using its SHA1 hash
-func GetModrinthURL(hash, path string) (string, error) {
-	// Extract filename from path
-	filename := filepath.Base(path)
+// ModrinthProject represents the parts of a Modrinth project we care about
+type ModrinthProject struct {
+	ID         string `json:"id"`
+	Slug       string `json:"slug"`
+	Title      string `json:"title"`
+	ClientSide string `json:"client_side"` // required, optional, unsupported or unknown
+	ServerSide string `json:"server_side"`
+}
+
+// Side returns where the project has to be installed, see parsers.SideBoth
+func (p *ModrinthProject) Side() string {
+	switch {
+	case p.ClientSide == "unsupported" && p.ServerSide != "unsupported":
+		return parsers.SideServer
+	case p.ServerSide == "unsupported" && p.ClientSide != "unsupported":
+		return parsers.SideClient
+	default:
+		return parsers.SideBoth
+	}
+}
 
-	// Make request to Modrinth API
-	url := fmt.Sprintf("https://api.modrinth.com/v2/version_file/%s", hash)
+// getModrinthJSON requests url from the Modrinth API and decodes the response into v.
+// It returns false when Modrinth does not know what we asked for.
+func getModrinthJSON(url string, v any) (bool, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		utils.LogError(err)
-		return "", err
+		return false, err
 	}
 	defer resp.Body.Close()
 
-	// If not found (404), return empty string
+	// If not found (404), there is nothing to decode
 	if resp.StatusCode == http.StatusNotFound {
-		return "", nil
+		return false, nil
 	}
 
 	// Check for other non-200 status codes
 	if resp.StatusCode != http.StatusOK {
 		utils.LogError(fmt.Errorf("modrinth API returned status %d", resp.StatusCode))
-		return "", fmt.Errorf("modrinth API returned status %d", resp.StatusCode)
+		return false, fmt.Errorf("modrinth API returned status %d", resp.StatusCode)
 	}
 
 	// Parse JSON response
-	var versionResp ModrinthVersionResponse
-	if err := json.NewDecoder(resp.Body).Decode(&versionResp); err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
 		utils.LogError(fmt.Errorf("failed to decode modrinth response: %v", err))
-		return "", fmt.Errorf("failed to decode modrinth response: %v", err)
+		return false, fmt.Errorf("failed to decode modrinth response: %v", err)
 	}
+	return true, nil
+}
+
+// LookupModrinthVersion finds the Modrinth version a file belongs to by its SHA1 hash, nil when it is not on Modrinth
+func LookupModrinthVersion(hash string) (*ModrinthVersionResponse, error) {
+	var versionResp ModrinthVersionResponse
+	found, err := getModrinthJSON(fmt.Sprintf("https://api.modrinth.com/v2/version_file/%s", hash), &versionResp)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &versionResp, nil
+}
+
+// GetModrinthProject fetches a project by its ID or slug, nil when it does not exist
+func GetModrinthProject(id string) (*ModrinthProject, error) {
+	var project ModrinthProject
+	found, err := getModrinthJSON(fmt.Sprintf("https://api.modrinth.com/v2/project/%s", id), &project)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &project, nil
+}
 
+// FileURL returns the download URL of the file called filename in the version,
+// falling back to the primary file and then the first one
+func (v *ModrinthVersionResponse) FileURL(filename string) string {
 	// If no files, return empty string
-	if len(versionResp.Files) == 0 {
-		return "", nil
+	if len(v.Files) == 0 {
+		return ""
 	}
 
 	// If only one file, return its URL
-	if len(versionResp.Files) == 1 {
-		return versionResp.Files[0].URL, nil
+	if len(v.Files) == 1 {
+		return v.Files[0].URL
 	}
 
 	// Multiple files - find matching filename
-	for _, file := range versionResp.Files {
+	for _, file := range v.Files {
 		if file.Filename == filename {
-			return file.URL, nil
+			return file.URL
 		}
 	}
 
 	// If no matching filename found, return the primary file or first file
-	for _, file := range versionResp.Files {
+	for _, file := range v.Files {
 		if file.Primary {
-			return file.URL, nil
+			return file.URL
 		}
 	}
 
 	// Fallback to first file
-	return versionResp.Files[0].URL, nil
+	return v.Files[0].URL
 }
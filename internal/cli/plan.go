@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+	"github.com/cosmiclabstudio/cargodrop/internal/workers"
+)
+
+// Plan output formats
+const (
+	PlanFormatText = "text"
+	PlanFormatJSON = "json"
+)
+
+// PrintPlan writes the summary of an update plan to w in the given format
+func PrintPlan(w io.Writer, summary *workers.PlanSummary, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	case PlanFormatText, "":
+		return printPlanText(w, summary)
+	default:
+		return fmt.Errorf("unknown plan format %q, expected %s or %s", format, PlanFormatText, PlanFormatJSON)
+	}
+}
+
+func printPlanText(w io.Writer, summary *workers.PlanSummary) error {
+	var lines []string
+	if !summary.UpdateAvailable {
+		lines = append(lines, "Everything is up to date ("+summary.ToVersion+").")
+	} else {
+		from := summary.FromVersion
+		if from == "" {
+			from = "nothing"
+		}
+		lines = append(lines, fmt.Sprintf("Update available: %s -> %s", from, summary.ToVersion))
+		lines = append(lines, fmt.Sprintf("%d new, %d changed, %d removed, %s to download",
+			len(summary.Added), len(summary.Updated), len(summary.Removed), utils.FormatSize(summary.DownloadBytes)))
+
+		for _, file := range summary.Added {
+			lines = append(lines, fmt.Sprintf("  + %s (%s)", file.Path, utils.FormatSize(file.Size)))
+		}
+		for _, file := range summary.Updated {
+			size := utils.FormatSize(file.Size)
+			if file.Patched {
+				size += " patch"
+			}
+			lines = append(lines, fmt.Sprintf("  ~ %s (%s)", file.Path, size))
+		}
+		for _, path := range summary.Removed {
+			lines = append(lines, "  - "+path)
+		}
+	}
+
+	if len(summary.MissingURL) > 0 {
+		lines = append(lines, fmt.Sprintf("%d files have no download URL and will be skipped:", len(summary.MissingURL)))
+		for _, path := range summary.MissingURL {
+			lines = append(lines, "  ! "+path)
+		}
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	// redrawInterval keeps the progress bar from flooding the terminal
+	redrawInterval = 100 * time.Millisecond
+	// speedWindow is how far back we look when working out the download speed
+	speedWindow = 3 * time.Second
+	barWidth    = 30
+)
+
+// speedSample is the amount downloaded at a point in time
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// Terminal is the headless counterpart of gui.MainWindow, it renders logs and progress to stderr.
+// On an interactive terminal it draws a progress bar with speed and ETA, otherwise it prints plain lines
+// so the output stays readable in log files and CI.
+type Terminal struct {
+	UpdateProgress func(fileName string, downloadedBytes, totalBytes int64, processed, total int)
+	HandleError    func(message string, err error)
+
+	out         *os.File
+	interactive bool
+
+	mu            sync.Mutex
+	status        string
+	statusVisible bool
+	lastDraw      time.Time
+	lastProcessed int
+	samples       []speedSample
+}
+
+// NewTerminal creates the terminal renderer and registers it as the log output
+func NewTerminal() *Terminal {
+	t := &Terminal{
+		out:           os.Stderr,
+		interactive:   isTerminal(os.Stderr),
+		lastProcessed: -1,
+	}
+	t.UpdateProgress = t.updateProgress
+	t.HandleError = t.handleError
+
+	utils.RegisterGuiLogCallback(t.appendLog)
+	return t
+}
+
+// Finish leaves the last progress line on screen and moves the cursor below it
+func (t *Terminal) Finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.statusVisible {
+		_, _ = fmt.Fprintln(t.out)
+		t.statusVisible = false
+	}
+}
+
+func (t *Terminal) appendLog(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	line = strings.TrimRight(line, "\n")
+	if t.interactive {
+		switch {
+		case strings.Contains(line, "ERROR: "):
+			line = utils.ColorRed + line + utils.ColorReset
+		case strings.Contains(line, "WARNING: "):
+			line = utils.ColorYellow + line + utils.ColorReset
+		}
+	}
+
+	// the log line goes above the progress bar, which is drawn again right after it
+	t.clearStatus()
+	_, _ = fmt.Fprintln(t.out, line)
+	t.drawStatus()
+}
+
+func (t *Terminal) updateProgress(fileName string, downloadedBytes, totalBytes int64, processed, total int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.samples = append(t.samples, speedSample{at: now, bytes: downloadedBytes})
+	for len(t.samples) > 2 && now.Sub(t.samples[0].at) > speedWindow {
+		t.samples = t.samples[1:]
+	}
+
+	if !t.interactive {
+		// one line per finished file is plenty for a log file
+		if processed == t.lastProcessed {
+			return
+		}
+		t.lastProcessed = processed
+		line := fmt.Sprintf("[%d/%d]", processed, total)
+		if totalBytes > 0 {
+			line += " " + utils.FormatSize(downloadedBytes) + "/" + utils.FormatSize(totalBytes)
+		} else if fileName != "" {
+			line += " " + fileName
+		}
+		_, _ = fmt.Fprintln(t.out, line)
+		return
+	}
+
+	done := processed == total
+	if !done && now.Sub(t.lastDraw) < redrawInterval {
+		return
+	}
+	t.lastDraw = now
+
+	var percent float64
+	if total > 0 {
+		percent = float64(processed) / float64(total)
+	} else {
+		percent = 1.0
+	}
+
+	// If totalBytes is 0, we're in generating metadata mode, show file count only
+	status := fmt.Sprintf("%s %d/%d", renderBar(percent), processed, total)
+	if totalBytes > 0 {
+		speed := t.speed()
+		status += "  " + utils.FormatSize(downloadedBytes) + "/" + utils.FormatSize(totalBytes)
+		status += "  " + utils.FormatSize(int64(speed)) + "/s"
+		if speed > 0 && downloadedBytes < totalBytes {
+			eta := time.Duration(float64(totalBytes-downloadedBytes) / speed * float64(time.Second))
+			status += "  ETA " + eta.Round(time.Second).String()
+		}
+	}
+	if fileName != "" {
+		status += "  " + fileName
+	}
+
+	t.clearStatus()
+	t.status = status
+	t.drawStatus()
+}
+
+func (t *Terminal) handleError(message string, err error) {
+	t.Finish()
+	utils.LogMessage("Failed to update resources: " + message)
+	utils.LogMessage("Please report this issue to your server administrator along with the log.")
+}
+
+// speed returns the download speed in bytes per second over the last few seconds
+func (t *Terminal) speed() float64 {
+	if len(t.samples) < 2 {
+		return 0
+	}
+	first, last := t.samples[0], t.samples[len(t.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+func (t *Terminal) clearStatus() {
+	if t.statusVisible {
+		_, _ = fmt.Fprint(t.out, "\r\033[2K")
+		t.statusVisible = false
+	}
+}
+
+func (t *Terminal) drawStatus() {
+	if t.interactive && t.status != "" {
+		_, _ = fmt.Fprint(t.out, t.status)
+		t.statusVisible = true
+	}
+}
+
+func renderBar(percent float64) string {
+	filled := int(percent * barWidth)
+	filled = min(max(filled, 0), barWidth)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled) + "]"
+}
+
+// isTerminal reports whether f is attached to a terminal rather than a pipe or a file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// HasDisplay reports whether a window can be opened at all, on Linux and BSD that needs an X11 or Wayland session
+func HasDisplay() bool {
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "android":
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
@@ -43,6 +43,51 @@ type MainWindow struct {
 	Window         fyne.Window
 	UpdateProgress func(fileName string, downloadedBytes, totalBytes int64, processed, total int)
 	HandleError    func(message string, err error)
+	ShowBackups    func(backupDir string, files []string)
+	ShowProblems   func(problems []string)
+	ChooseGroups   func(groups []parsers.Group, selected map[string]bool) map[string]bool
+	Hide           func()
+	// AllowChangeGroups enables the optional content button, it is turned off while an update runs
+	AllowChangeGroups func(allowed bool)
+
+	// OnChangeGroups is called when the player wants to change the optional content they picked
+	OnChangeGroups func()
+
+	// OnRateLimitChanged is called when the player picks another download speed limit, 0 means unlimited
+	OnRateLimitChanged func(bytesPerSecond int64)
+	// OnConnectionRateLimitChanged is called when the player picks another speed limit for every single download
+	OnConnectionRateLimitChanged func(bytesPerSecond int64)
+}
+
+// rateLimitChoices are the download speed limits offered in the window
+var rateLimitChoices = []int64{0, 512 * 1024, 1024 * 1024, 2 * 1024 * 1024, 5 * 1024 * 1024, 10 * 1024 * 1024}
+
+func rateLimitLabel(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "Unlimited"
+	}
+	return strings.Replace(utils.FormatSize(bytesPerSecond), ".00", "", 1) + "/s"
+}
+
+// newRateLimitSelect offers the usual speed limits along with the configured one and calls onChanged with the picked rate
+func newRateLimitSelect(what, configured string, onChanged func(bytesPerSecond int64)) *widget.Select {
+	currentRate, _ := utils.ParseSize(configured)
+	rateByLabel := make(map[string]int64)
+	var rateOptions []string
+	for _, rate := range append(rateLimitChoices, currentRate) {
+		label := rateLimitLabel(rate)
+		if _, exists := rateByLabel[label]; !exists {
+			rateByLabel[label] = rate
+			rateOptions = append(rateOptions, label)
+		}
+	}
+	rateSelect := widget.NewSelect(rateOptions, nil)
+	rateSelect.SetSelected(rateLimitLabel(currentRate))
+	rateSelect.OnChanged = func(label string) {
+		utils.LogMessage(what + ": " + label)
+		onChanged(rateByLabel[label])
+	}
+	return rateSelect
 }
 
 // NewMainWindow creates and returns the main window for the app
@@ -55,6 +100,8 @@ func NewMainWindow(a fyne.App, config *parsers.Config, resources *parsers.Resour
 	w.Resize(fyne.NewSize(900, 500))
 	w.CenterOnScreen()
 
+	mw := &MainWindow{Window: w}
+
 	// Custom progress bar (responsive width, 6px height, custom text)
 	bar := widget.NewProgressBar()
 	bar.Resize(fyne.NewSize(0, 16))
@@ -134,6 +181,104 @@ func NewMainWindow(a fyne.App, config *parsers.Config, resources *parsers.Resour
 		utils.LogMessage("You may close this window to continue launching your game.")
 	}
 
+	// Tell the player where their own versions of replaced files went
+	showBackups := func(backupDir string, files []string) {
+		fyne.Do(func() {
+			list := "  " + strings.Join(files, "\n  ")
+			dialog.ShowInformation(
+				"Your changes were backed up",
+				"These files were changed on your computer and have been replaced by the update:\n\n"+list+
+					"\n\nYour versions are kept in:\n"+backupDir,
+				w)
+		})
+	}
+
+	// Tell the admin what is wrong with the config before anything runs
+	showProblems := func(problems []string) {
+		fyne.Do(func() {
+			list := widget.NewLabel(strings.Join(problems, "\n"))
+			list.TextStyle = fyne.TextStyle{Monospace: true}
+			list.Wrapping = fyne.TextWrapWord
+
+			content := container.NewBorder(
+				widget.NewLabel("The updater cannot start until these problems are fixed:"), nil, nil, nil,
+				container.NewVScroll(list))
+			d := dialog.NewCustom("Invalid configuration", "Close", content, w)
+			d.Resize(fyne.NewSize(700, 400))
+			d.Show()
+		})
+	}
+
+	// Let the player pick the optional content, the update waits until the dialog is closed
+	chooseGroups := func(groups []parsers.Group, selected map[string]bool) map[string]bool {
+		result := make(map[string]bool, len(selected))
+		for name, on := range selected {
+			result[name] = on
+		}
+
+		done := make(chan struct{})
+		fyne.Do(func() {
+			items := []fyne.CanvasObject{widget.NewLabel("This pack comes with optional content, pick what you want to install:")}
+			for _, group := range groups {
+				name := group.Name
+				check := widget.NewCheck(name, nil)
+				check.SetChecked(result[name])
+				check.OnChanged = func(on bool) {
+					result[name] = on
+				}
+				items = append(items, check)
+
+				if group.Description != "" {
+					description := widget.NewLabel(group.Description)
+					description.Wrapping = fyne.TextWrapWord
+					description.TextStyle = fyne.TextStyle{Italic: true}
+					items = append(items, description)
+				}
+			}
+
+			d := dialog.NewCustom("Optional content", "Continue", container.NewVScroll(container.NewVBox(items...)), w)
+			d.SetOnClosed(func() { close(done) })
+			d.Resize(fyne.NewSize(500, 400))
+			d.Show()
+		})
+		<-done
+		return result
+	}
+
+	// The optional content can be changed at any time, which runs the update again with the new choice
+	groupsButton := widget.NewButton("Optional content", func() {
+		if mw.OnChangeGroups != nil {
+			mw.OnChangeGroups()
+		}
+	})
+	groupsButton.Disable()
+	allowChangeGroups := func(allowed bool) {
+		fyne.Do(func() {
+			if allowed {
+				groupsButton.Enable()
+			} else {
+				groupsButton.Disable()
+			}
+		})
+	}
+
+	// Get out of the way while the game runs
+	hide := func() {
+		fyne.Do(w.Hide)
+	}
+
+	// Download speed limits, they apply to the running update right away
+	rateSelect := newRateLimitSelect("Download speed limit", config.DownloadRateLimit, func(rate int64) {
+		if mw.OnRateLimitChanged != nil {
+			mw.OnRateLimitChanged(rate)
+		}
+	})
+	connectionRateSelect := newRateLimitSelect("Speed limit per download", config.ConnectionRateLimit, func(rate int64) {
+		if mw.OnConnectionRateLimitChanged != nil {
+			mw.OnConnectionRateLimitChanged(rate)
+		}
+	})
+
 	creditLeft := canvas.NewText(utils.GetFullVersionString(), color.White)
 	creditLeft.TextSize = 12
 	creditRight := canvas.NewText("Made with ❤️ by Cosmic Lab Studio", color.White)
@@ -141,6 +286,14 @@ func NewMainWindow(a fyne.App, config *parsers.Config, resources *parsers.Resour
 
 	// Bottom section with progress and credits
 	bottomSection := container.NewVBox(
+		container.NewHBox(
+			groupsButton,
+			layout.NewSpacer(),
+			widget.NewLabel("Download limit:"),
+			rateSelect,
+			widget.NewLabel("Per download:"),
+			connectionRateSelect,
+		),
 		progressBar,
 		container.NewHBox(
 			creditLeft,
@@ -163,11 +316,13 @@ func NewMainWindow(a fyne.App, config *parsers.Config, resources *parsers.Resour
 	w.Resize(fyne.NewSize(900, 500))
 	w.CenterOnScreen()
 
-	mw := &MainWindow{
-		Window:         w,
-		UpdateProgress: updateProgress,
-		HandleError:    handleError,
-	}
+	mw.UpdateProgress = updateProgress
+	mw.HandleError = handleError
+	mw.ShowBackups = showBackups
+	mw.ShowProblems = showProblems
+	mw.ChooseGroups = chooseGroups
+	mw.Hide = hide
+	mw.AllowChangeGroups = allowChangeGroups
 
 	return mw
 }
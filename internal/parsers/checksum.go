@@ -0,0 +1,40 @@
+package parsers
+
+import (
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// Checksum is the hash of a file along with the algorithm that produced it, the zero value checks nothing
+type Checksum struct {
+	Algorithm string
+	Value     string
+}
+
+// IsZero reports whether there is no hash to check against
+func (c Checksum) IsZero() bool {
+	return c.Value == ""
+}
+
+// lowerHashes turns every value of hashes into lowercase hex, which is how hashes are computed and compared
+func lowerHashes(hashes map[string]string) {
+	for name, value := range hashes {
+		hashes[name] = strings.ToLower(value)
+	}
+}
+
+// strongestChecksum picks the strongest supported hash out of the legacy sha1 field and the named hashes.
+// Algorithms this build does not know about are skipped.
+func strongestChecksum(sha1 string, hashes map[string]string) Checksum {
+	for i := len(utils.HashAlgorithms) - 1; i >= 0; i-- {
+		name := utils.HashAlgorithms[i]
+		if value := hashes[name]; value != "" {
+			return Checksum{Algorithm: name, Value: value}
+		}
+	}
+	if sha1 != "" {
+		return Checksum{Algorithm: utils.HashSHA1, Value: sha1}
+	}
+	return Checksum{}
+}
@@ -3,13 +3,83 @@ package parsers
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	// DefaultMaxConcurrentDownloads is used when the config does not set max_concurrent_downloads
+	DefaultMaxConcurrentDownloads = 6
+	// DefaultMaxConnectionsPerHost is used when the config does not set max_connections_per_host
+	DefaultMaxConnectionsPerHost = 4
+	// DefaultRetryAttempts is how many times a download location is tried before moving on
+	DefaultRetryAttempts = 4
+	// DefaultRetryInitialDelayMs is the wait before the first retry, it doubles with every attempt
+	DefaultRetryInitialDelayMs = 1000
+	// DefaultRetryMaxDelayMs caps the wait between two attempts
+	DefaultRetryMaxDelayMs = 30000
+	// DefaultCacheMaxSize is how large the shared download cache may grow before old files are evicted
+	DefaultCacheMaxSize = "10GB"
 )
 
+// DefaultHashAlgorithms are the hashes the generator adds next to sha1 when the config does not say
+var DefaultHashAlgorithms = []string{utils.HashSHA256}
+
+const (
+	// StaleActionQuarantine moves files that are no longer in the manifest to .cargodrop/quarantine
+	StaleActionQuarantine = "quarantine"
+	// StaleActionDelete removes files that are no longer in the manifest for good
+	StaleActionDelete = "delete"
+)
+
+// RetryConfig controls how failed downloads are retried
+type RetryConfig struct {
+	MaxAttempts    int `json:"max_attempts,omitempty"`
+	InitialDelayMs int `json:"initial_delay_ms,omitempty"`
+	MaxDelayMs     int `json:"max_delay_ms,omitempty"`
+}
+
+// CacheConfig controls the download cache that is shared by every instance on this computer
+type CacheConfig struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir,omitempty"`      // defaults to cargodrop in the user cache folder
+	MaxSize string `json:"max_size,omitempty"` // e.g. "10GB"
+	// Hardlinks places cached files with hardlinks where possible. It saves the most space, but a file the player
+	// edits in place changes the cached copy as well, which is then thrown away the next time it is used.
+	Hardlinks bool `json:"hardlinks,omitempty"`
+}
+
+// LaunchConfig is a command started after the update, like the game or its launcher.
+// Command, Args and Dir can use ${base_dir}, ${version}, ${name}, ${side}, ${status} and environment variables.
+type LaunchConfig struct {
+	Command   string   `json:"command"`
+	Args      []string `json:"args,omitempty"`
+	Dir       string   `json:"dir,omitempty"`        // working directory, defaults to the base directory
+	OnFailure bool     `json:"on_failure,omitempty"` // launch even when the update failed
+}
+
 type Config struct {
-	Name           string   `json:"name"`
-	WelcomeMessage string   `json:"welcome_message"`
-	Folders        []string `json:"folders"`
-	UpdateServer   string   `json:"update_server"`
+	Name                   string        `json:"name"`
+	WelcomeMessage         string        `json:"welcome_message"`
+	Folders                []FolderSpec  `json:"folders"`
+	UpdateServer           string        `json:"update_server"`
+	MaxConcurrentDownloads int           `json:"max_concurrent_downloads,omitempty"`
+	MaxConnectionsPerHost  int           `json:"max_connections_per_host,omitempty"`
+	PruneFolders           []string      `json:"prune_folders,omitempty"` // deprecated, same as a folder with the mirror policy
+	StaleAction            string        `json:"stale_action,omitempty"`
+	PatchURL               string        `json:"patch_url,omitempty"` // where the generated patches folder is uploaded, empty disables patches
+	Retry                  RetryConfig   `json:"retry,omitempty"`
+	DownloadRateLimit      string        `json:"download_rate_limit,omitempty"`   // per second for all downloads together, e.g. "2MB"
+	ConnectionRateLimit    string        `json:"connection_rate_limit,omitempty"` // per second for every single download
+	Cache                  CacheConfig   `json:"cache,omitempty"`
+	Groups                 []GroupConfig `json:"groups,omitempty"` // optional content, copied into resources.json by the generator
+	Launch                 *LaunchConfig `json:"launch,omitempty"`
+	Updater                *Release      `json:"updater,omitempty"`         // cargodrop release players should run, copied into resources.json by the generator
+	TrustedKeys            []string      `json:"trusted_keys,omitempty"`    // base64 ed25519 public keys, resources.json must be signed by one of them
+	SigningKey             string        `json:"signing_key,omitempty"`     // private key file the generator signs resources.json with
+	HashAlgorithms         []string      `json:"hash_algorithms,omitempty"` // hashes the generator adds next to sha1, defaults to DefaultHashAlgorithms
+
+	source []byte // the file the config was read from, for the positions in Validate
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -19,7 +89,52 @@ func LoadConfig(path string) (*Config, error) {
 	}
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+		return nil, jsonError(path, data, err)
+	}
+	cfg.source = data
+
+	// fill in the defaults for anything the admin left out
+	if cfg.MaxConcurrentDownloads <= 0 {
+		cfg.MaxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	if cfg.MaxConnectionsPerHost <= 0 {
+		cfg.MaxConnectionsPerHost = DefaultMaxConnectionsPerHost
+	}
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry.MaxAttempts = DefaultRetryAttempts
+	}
+	if cfg.Retry.InitialDelayMs <= 0 {
+		cfg.Retry.InitialDelayMs = DefaultRetryInitialDelayMs
+	}
+	if cfg.Retry.MaxDelayMs <= 0 {
+		cfg.Retry.MaxDelayMs = DefaultRetryMaxDelayMs
+	}
+	if cfg.Cache.MaxSize == "" {
+		cfg.Cache.MaxSize = DefaultCacheMaxSize
+	}
+	// prune_folders predates folder policies, they are mirrored folders
+	for _, prune := range cfg.PruneFolders {
+		found := false
+		for i := range cfg.Folders {
+			if cleanFolderPath(cfg.Folders[i].Path) == cleanFolderPath(prune) {
+				found = true
+				if cfg.Folders[i].Policy == FolderPolicySync {
+					cfg.Folders[i].Policy = FolderPolicyMirror
+				}
+			}
+		}
+		if !found {
+			cfg.Folders = append(cfg.Folders, FolderSpec{Path: prune, Policy: FolderPolicyMirror})
+		}
+	}
+	if cfg.StaleAction == "" {
+		cfg.StaleAction = StaleActionQuarantine
+	}
+	if len(cfg.HashAlgorithms) == 0 {
+		cfg.HashAlgorithms = DefaultHashAlgorithms
+	}
+	if cfg.Updater != nil {
+		cfg.Updater.normalizeHashes()
 	}
 	return &cfg, nil
 }
@@ -0,0 +1,109 @@
+package parsers
+
+import (
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// FolderPolicySync updates and adds the files of the pack and removes the ones it dropped, other files are left alone
+	FolderPolicySync = ""
+	// FolderPolicyMirror keeps the folder exactly like the pack, any other file in it is removed
+	FolderPolicyMirror = "mirror"
+	// FolderPolicyAdditive adds and updates files but never removes anything
+	FolderPolicyAdditive = "additive"
+	// FolderPolicySeedOnce only creates missing files and never touches them again, for default configs
+	FolderPolicySeedOnce = "seed-once"
+)
+
+// FolderSpec is one entry of Config.Folders. In the config it is either a plain folder name,
+// or an object with the folder, its policy and glob patterns of files the updater should never touch.
+type FolderSpec struct {
+	Path   string   `json:"path"`
+	Policy string   `json:"policy,omitempty"`
+	Ignore []string `json:"ignore,omitempty"` // matched against the path inside the folder and against the file name
+}
+
+// UnmarshalJSON accepts both the old plain string form and the object form
+func (f *FolderSpec) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err == nil {
+		*f = FolderSpec{Path: plain}
+		return nil
+	}
+
+	type folderSpec FolderSpec // no UnmarshalJSON, so this does not recurse
+	var spec folderSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	// the policy is checked by Config.Validate, which knows where in the file it is
+	*f = FolderSpec(spec)
+	return nil
+}
+
+// String is how the folder shows up in the log
+func (f FolderSpec) String() string {
+	if f.Policy == "" {
+		return f.Path
+	}
+	return f.Path + " (" + f.Policy + ")"
+}
+
+// Contains reports whether the forward slash path, relative to the base directory, is inside the folder
+func (f FolderSpec) Contains(p string) bool {
+	folder := cleanFolderPath(f.Path)
+	return folder == "." || p == folder || strings.HasPrefix(p, folder+"/")
+}
+
+// Ignores reports whether the forward slash path, relative to the base directory, matches one of the ignore patterns
+func (f FolderSpec) Ignores(p string) bool {
+	if len(f.Ignore) == 0 || !f.Contains(p) {
+		return false
+	}
+	inside := strings.TrimPrefix(strings.TrimPrefix(p, cleanFolderPath(f.Path)), "/")
+	for _, pattern := range f.Ignore {
+		if ok, _ := path.Match(pattern, inside); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanFolderPath(folder string) string {
+	return path.Clean(filepath.ToSlash(strings.ReplaceAll(folder, "\\", "/")))
+}
+
+// FolderFor returns the most specific folder of the config that contains the forward slash path p
+func (c *Config) FolderFor(p string) (FolderSpec, bool) {
+	var best FolderSpec
+	found := false
+	for _, folder := range c.Folders {
+		if folder.Contains(p) && (!found || len(cleanFolderPath(folder.Path)) > len(cleanFolderPath(best.Path))) {
+			best = folder
+			found = true
+		}
+	}
+	return best, found
+}
+
+// PolicyFor returns the sync policy of the folder containing p
+func (c *Config) PolicyFor(p string) string {
+	folder, _ := c.FolderFor(p)
+	return folder.Policy
+}
+
+// IsIgnored reports whether the updater should leave p alone because of an ignore pattern of its folder
+func (c *Config) IsIgnored(p string) bool {
+	for _, folder := range c.Folders {
+		if folder.Ignores(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package parsers
+
+import "path"
+
+// Group is a named set of optional resources the player can choose to install, like shaders or a minimap
+type Group struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Default     bool   `json:"default,omitempty"` // installed unless the player turns it off
+}
+
+// GroupConfig tells the generator which files belong to an optional group
+type GroupConfig struct {
+	Group
+	Files []string `json:"files"` // glob patterns relative to the base directory, e.g. "mods/xaeros-minimap-*.jar"
+}
+
+// GroupFor returns the name of the first group whose patterns match the forward slash path p, or "" when it is not optional
+func (c *Config) GroupFor(p string) string {
+	for _, group := range c.Groups {
+		for _, pattern := range group.Files {
+			if ok, _ := path.Match(pattern, p); ok {
+				return group.Name
+			}
+		}
+	}
+	return ""
+}
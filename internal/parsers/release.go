@@ -0,0 +1,42 @@
+package parsers
+
+import "strings"
+
+// Release is the cargodrop build a pack wants its players to run, it is copied into resources.json by the generator
+type Release struct {
+	Version string         `json:"version"`
+	Builds  []ReleaseBuild `json:"builds"`
+}
+
+// ReleaseBuild is the executable of a Release for one operating system and architecture, as in GOOS and GOARCH
+type ReleaseBuild struct {
+	OS     string            `json:"os"`
+	Arch   string            `json:"arch"`
+	URL    string            `json:"url"`
+	Hash   string            `json:"hash"` // sha1 of the executable
+	Hashes map[string]string `json:"hashes,omitempty"`
+	Size   int64             `json:"size"`
+}
+
+// Checksum returns the strongest hash of the build this build of cargodrop supports
+func (b ReleaseBuild) Checksum() Checksum {
+	return strongestChecksum(b.Hash, b.Hashes)
+}
+
+// normalizeHashes lowercases every hash of the release, hand written manifests may use uppercase hex
+func (r *Release) normalizeHashes() {
+	for i := range r.Builds {
+		r.Builds[i].Hash = strings.ToLower(r.Builds[i].Hash)
+		lowerHashes(r.Builds[i].Hashes)
+	}
+}
+
+// BuildFor returns the build of the release for goos and goarch
+func (r *Release) BuildFor(goos, goarch string) (ReleaseBuild, bool) {
+	for _, build := range r.Builds {
+		if build.OS == goos && build.Arch == goarch {
+			return build, true
+		}
+	}
+	return ReleaseBuild{}, false
+}
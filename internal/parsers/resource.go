@@ -3,26 +3,111 @@ package parsers
 import (
 	"encoding/json"
 	"os"
+	"sort"
+	"strings"
 )
 
+// Mirror is an alternative download location for a resource, higher weights are tried first
+type Mirror struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
 type Resource struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
-	Size int64  `json:"size"`
-	URL  string `json:"url"`
+	Path    string            `json:"path"`
+	Hash    string            `json:"hash"`             // sha1, kept for Modrinth lookups and older clients
+	Hashes  map[string]string `json:"hashes,omitempty"` // more hashes by algorithm name, like sha256 and sha512
+	Size    int64             `json:"size"`
+	URL     string            `json:"url"`
+	Mirrors []Mirror          `json:"mirrors,omitempty"`
+	Policy  string            `json:"policy,omitempty"` // sync policy of the folder the generator found it in, see FolderPolicySync
+	Group   string            `json:"group,omitempty"`  // optional group the resource belongs to, empty means it is always installed
+	Side    string            `json:"side,omitempty"`   // client, server or both, empty means both
+}
+
+const (
+	// SideClient resources are only installed for players
+	SideClient = "client"
+	// SideServer resources are only installed on the dedicated server
+	SideServer = "server"
+	// SideBoth resources are installed everywhere
+	SideBoth = "both"
+)
+
+// IsFor reports whether the resource should be installed on side, SideBoth takes everything
+func (r Resource) IsFor(side string) bool {
+	return side == SideBoth || r.Side == "" || r.Side == SideBoth || r.Side == side
+}
+
+// Checksum returns the strongest hash of the resource this build supports
+func (r Resource) Checksum() Checksum {
+	return strongestChecksum(r.Hash, r.Hashes)
 }
 
+// DownloadURLs returns every place the resource can be downloaded from in the order they should be tried:
+// the main URL first, then the mirrors by descending weight, keeping the listed order for equal weights.
+func (r Resource) DownloadURLs() []string {
+	mirrors := make([]Mirror, len(r.Mirrors))
+	copy(mirrors, r.Mirrors)
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		return mirrors[i].Weight > mirrors[j].Weight
+	})
+
+	var urls []string
+	seen := make(map[string]bool)
+	for _, url := range append([]string{r.URL}, mirrorURLs(mirrors)...) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func mirrorURLs(mirrors []Mirror) []string {
+	urls := make([]string, len(mirrors))
+	for i, m := range mirrors {
+		urls[i] = m.URL
+	}
+	return urls
+}
+
+// Patches is a binary delta that turns the file at Path with hash FromHash into ToHash.
+// Version is the pack version FromHash was published with, Size and Hashes describe the patch itself.
 type Patches struct {
-	Version string `json:"version"`
-	URL     string `json:"url"`
+	Version  string            `json:"version"`
+	URL      string            `json:"url"`
+	Path     string            `json:"path,omitempty"`
+	FromHash string            `json:"from_hash,omitempty"`
+	ToHash   string            `json:"to_hash,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+	Hashes   map[string]string `json:"hashes,omitempty"`
+}
+
+// Checksum returns the strongest hash of the patch file this build supports
+func (p Patches) Checksum() Checksum {
+	return strongestChecksum("", p.Hashes)
+}
+
+// Tombstone marks a path that was removed from the pack. When Hash is set, only a file
+// with that exact content is removed, so a player's own file with the same name is left alone.
+type Tombstone struct {
+	Path string `json:"path"`
+	Hash string `json:"hash,omitempty"`
 }
 
 type ResourceSet struct {
-	Name            string     `json:"name"`
-	LocalVersion    string     `json:"version"`
-	ResourceSetHash string     `json:"resource_set_hash"`
-	Patches         []Patches  `json:"patches"`
-	Resources       []Resource `json:"resources"`
+	SchemaVersion   int         `json:"schema_version"`
+	Name            string      `json:"name"`
+	LocalVersion    string      `json:"version"`
+	ResourceSetHash string      `json:"resource_set_hash"`
+	Patches         []Patches   `json:"patches"`
+	Resources       []Resource  `json:"resources"`
+	Removed         []Tombstone `json:"removed,omitempty"`
+	Groups          []Group     `json:"groups,omitempty"`
+	Updater         *Release    `json:"updater,omitempty"`
+
+	source []byte // the file the set was read from, for the positions in Validate
 }
 
 func LoadResource(path string) (*ResourceSet, error) {
@@ -30,9 +115,40 @@ func LoadResource(path string) (*ResourceSet, error) {
 	if err != nil {
 		return nil, err
 	}
-	var rs ResourceSet
-	if err := json.Unmarshal(data, &rs); err != nil {
+	return ParseResource(data)
+}
+
+// ParseResource parses a resources.json that was already read, for when the raw bytes have to be checked first.
+// Older layouts are upgraded to the current schema, a *SchemaVersionError is returned for newer ones.
+func ParseResource(data []byte) (*ResourceSet, error) {
+	migrated, err := migrateManifest(data)
+	if err != nil {
 		return nil, err
 	}
+	var rs ResourceSet
+	if err := json.Unmarshal(migrated, &rs); err != nil {
+		return nil, jsonError("resources.json", migrated, err)
+	}
+	rs.source = data
+	rs.normalizeHashes()
 	return &rs, nil
 }
+
+// normalizeHashes lowercases every hash of the set, hand written manifests may use uppercase hex
+func (rs *ResourceSet) normalizeHashes() {
+	for i := range rs.Resources {
+		rs.Resources[i].Hash = strings.ToLower(rs.Resources[i].Hash)
+		lowerHashes(rs.Resources[i].Hashes)
+	}
+	for i := range rs.Patches {
+		rs.Patches[i].FromHash = strings.ToLower(rs.Patches[i].FromHash)
+		rs.Patches[i].ToHash = strings.ToLower(rs.Patches[i].ToHash)
+		lowerHashes(rs.Patches[i].Hashes)
+	}
+	for i := range rs.Removed {
+		rs.Removed[i].Hash = strings.ToLower(rs.Removed[i].Hash)
+	}
+	if rs.Updater != nil {
+		rs.Updater.normalizeHashes()
+	}
+}
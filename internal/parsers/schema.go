@@ -0,0 +1,200 @@
+package parsers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// CurrentSchemaVersion is the newest resources.json layout this build understands.
+// Version 1 is the layout from before schema_version existed, with local_version, filename and location.
+const CurrentSchemaVersion = 2
+
+// SchemaVersionError is returned for a resources.json written for a newer cargodrop than this one
+type SchemaVersionError struct {
+	Version int
+	Updater *Release // the release the manifest asks for, a self-update may still get us there
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("resources.json uses schema version %d, this version of cargodrop only understands up to %d", e.Version, CurrentSchemaVersion)
+}
+
+// manifestMigrations upgrade a decoded resources.json by one schema version, the one at index i turns version i+1 into i+2
+var manifestMigrations = []func(doc map[string]any){
+	migrateLegacyFieldNames,
+}
+
+// migrateLegacyFieldNames renames the fields of schema version 1 to what ResourceSet expects
+func migrateLegacyFieldNames(doc map[string]any) {
+	renameField(doc, "local_version", "version")
+	for _, item := range asList(doc["resources"]) {
+		r, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		renameField(r, "location", "path")
+		// the path already ends in the file name, it only stands in when there is no location
+		renameField(r, "filename", "path")
+		delete(r, "filename")
+	}
+}
+
+func renameField(doc map[string]any, from, to string) {
+	value, ok := doc[from]
+	if !ok {
+		return
+	}
+	if _, exists := doc[to]; !exists {
+		doc[to] = value
+	}
+	delete(doc, from)
+}
+
+func asList(value any) []any {
+	list, _ := value.([]any)
+	return list
+}
+
+// schemaVersionOf returns the schema version of doc, manifests from before schema_version are recognised by their field names
+func schemaVersionOf(doc map[string]any) (int, error) {
+	if raw, ok := doc["schema_version"]; ok {
+		version, ok := raw.(float64)
+		if !ok || version != math.Trunc(version) || version < 1 {
+			return 0, fmt.Errorf("invalid schema_version %v", raw)
+		}
+		return int(version), nil
+	}
+
+	if _, legacy := doc["local_version"]; legacy {
+		return 1, nil
+	}
+	for _, item := range asList(doc["resources"]) {
+		if r, ok := item.(map[string]any); ok {
+			_, hasLocation := r["location"]
+			_, hasFilename := r["filename"]
+			if hasLocation || hasFilename {
+				return 1, nil
+			}
+		}
+	}
+	return CurrentSchemaVersion, nil
+}
+
+// migrateManifest upgrades the raw resources.json in data to the current schema and returns it re-encoded
+func migrateManifest(data []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, jsonError("resources.json", data, err)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("resources.json is empty")
+	}
+
+	version, err := schemaVersionOf(doc)
+	if err != nil {
+		return nil, err
+	}
+	if version > CurrentSchemaVersion {
+		schemaErr := &SchemaVersionError{Version: version}
+		// the updater field is read on a best effort basis, it is what gets us out of this
+		var peek struct {
+			Updater *Release `json:"updater"`
+		}
+		if json.Unmarshal(data, &peek) == nil && peek.Updater != nil {
+			peek.Updater.normalizeHashes()
+			schemaErr.Updater = peek.Updater
+		}
+		return nil, schemaErr
+	}
+
+	if version < CurrentSchemaVersion {
+		utils.LogMessage(fmt.Sprintf("resources.json uses schema version %d, upgrading it to %d.", version, CurrentSchemaVersion))
+	}
+	upgradeManifest(doc, version)
+	return json.Marshal(doc)
+}
+
+// upgradeManifest runs every migration from version up to the current schema on doc
+func upgradeManifest(doc map[string]any, version int) {
+	for v := version; v < CurrentSchemaVersion; v++ {
+		manifestMigrations[v-1](doc)
+	}
+	doc["schema_version"] = CurrentSchemaVersion
+}
+
+// unknownFields returns the paths of every field in the decoded JSON value that has no counterpart in t, sorted
+func unknownFields(value any, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			// e.g. a FolderSpec given as a plain string, the type decodes that itself
+			return nil
+		}
+		fields := jsonFields(t)
+		for key, child := range obj {
+			field, known := fields[key]
+			if !known {
+				unknown = append(unknown, joinFieldPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownFields(child, field, joinFieldPath(path, key))...)
+		}
+	case reflect.Slice, reflect.Array:
+		for i, child := range asList(value) {
+			unknown = append(unknown, unknownFields(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		obj, _ := value.(map[string]any)
+		for key, child := range obj {
+			unknown = append(unknown, unknownFields(child, t.Elem(), joinFieldPath(path, key))...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// jsonFields maps the JSON names of the fields of the struct type t to their types, embedded structs included
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embedded, embeddedType := range jsonFields(field.Type) {
+				fields[embedded] = embeddedType
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinFieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,115 @@
+package parsers
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrateV1Manifest(t *testing.T) {
+	// the demo resources.json as it shipped before schema_version existed
+	data, err := os.ReadFile("testdata/resources_v1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := ParseResource(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.SchemaVersion != CurrentSchemaVersion {
+		t.Errorf("schema_version = %d, want %d", rs.SchemaVersion, CurrentSchemaVersion)
+	}
+	if rs.LocalVersion != "1.5.0" {
+		t.Errorf("version = %q, want local_version 1.5.0", rs.LocalVersion)
+	}
+
+	want := []Resource{
+		{Path: "mods/letmedespawn.jar", Hash: "eebc9b4f6b5342d7f7e1120e0a27c2e5", Size: 4820952},
+		{Path: "mods/naturecompass.jar", Hash: "e9a2c6d2b2d8c8d4aee5f5a6b8c4e7f1", Size: 119834},
+		{Path: "mods/create-6.0.7.jar", Hash: "c0b8e5f9a3e4b9c1d2a7e3c5f7a8b1e6", Size: 54000000},
+	}
+	if len(rs.Resources) != len(want) {
+		t.Fatalf("got %d resources, want %d", len(rs.Resources), len(want))
+	}
+	for i, r := range rs.Resources {
+		if r.Path != want[i].Path || r.Hash != want[i].Hash || r.Size != want[i].Size {
+			t.Errorf("resources[%d] = %+v, want %+v", i, r, want[i])
+		}
+	}
+
+	// nothing of the old layout is left for the validator to complain about
+	for _, p := range rs.Validate() {
+		if strings.HasPrefix(p.Message, "unknown field") {
+			t.Errorf("old field left after migration: %s", p.Format("resources.json"))
+		}
+	}
+}
+
+func TestMigrateV1FilenameOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "location wins over filename",
+			data: `{"local_version": "1", "resources": [{"filename": "a.jar", "location": "mods/a.jar"}]}`,
+			want: "mods/a.jar",
+		},
+		{
+			name: "filename stands in for a missing location",
+			data: `{"local_version": "1", "resources": [{"filename": "a.jar"}]}`,
+			want: "a.jar",
+		},
+		{
+			name: "recognised by the resource fields alone",
+			data: `{"version": "1", "resources": [{"location": "mods/a.jar"}]}`,
+			want: "mods/a.jar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := ParseResource([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rs.Resources) != 1 || rs.Resources[0].Path != tt.want {
+				t.Errorf("resources = %+v, want path %q", rs.Resources, tt.want)
+			}
+		})
+	}
+}
+
+func TestTooNewSchema(t *testing.T) {
+	data := `{
+		"schema_version": 99,
+		"version": "9.0",
+		"resources": [{"path": "mods/a.jar", "something_new": true}],
+		"updater": {"version": "9.0", "builds": [{"os": "linux", "arch": "amd64", "url": "https://example.com/cargodrop"}]}
+	}`
+
+	_, err := ParseResource([]byte(data))
+	var schemaErr *SchemaVersionError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("got %v, want a *SchemaVersionError", err)
+	}
+	if schemaErr.Version != 99 {
+		t.Errorf("Version = %d, want 99", schemaErr.Version)
+	}
+	if schemaErr.Updater == nil || schemaErr.Updater.Version != "9.0" {
+		t.Errorf("Updater = %+v, want the release the manifest asks for", schemaErr.Updater)
+	}
+}
+
+func TestInvalidSchemaVersion(t *testing.T) {
+	for _, data := range []string{`{"schema_version": 0}`, `{"schema_version": 1.5}`, `{"schema_version": "2"}`} {
+		_, err := ParseResource([]byte(data))
+		var schemaErr *SchemaVersionError
+		if err == nil || errors.As(err, &schemaErr) {
+			t.Errorf("%s: got %v, want an invalid schema_version error", data, err)
+		}
+	}
+}
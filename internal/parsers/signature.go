@@ -0,0 +1,98 @@
+package parsers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignatureSuffix is appended to the resources.json URL and path for its detached signature
+const SignatureSuffix = ".sig"
+
+// ParsePublicKey decodes a base64 ed25519 public key as found in Config.TrustedKeys
+func ParsePublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %v", value, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q: expected %d bytes, got %d", value, ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// LoadPrivateKey reads a base64 ed25519 private key file as written by GenerateKeyPair
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("invalid private key in %s: expected %d bytes, got %d", path, ed25519.PrivateKeySize, len(key))
+}
+
+// GenerateKeyPair writes a new private key to privatePath, readable only by the owner, and returns the public key in base64
+func GenerateKeyPair(privatePath string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	// never overwrite a key that may already be trusted by players
+	file, err := os.OpenFile(privatePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(base64.StdEncoding.EncodeToString(private) + "\n"); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// PublicKeyOf returns the base64 public key belonging to private
+func PublicKeyOf(private ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(private.Public().(ed25519.PublicKey))
+}
+
+// SignData returns the detached base64 signature of data
+func SignData(private ed25519.PrivateKey, data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, data)) + "\n")
+}
+
+// VerifySignature checks the detached base64 signature of data against every trusted key,
+// a signature by any of them is accepted so keys can be rotated without breaking older clients.
+func VerifySignature(data, signature []byte, trustedKeys []string) error {
+	if len(trustedKeys) == 0 {
+		return errors.New("no trusted keys configured")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("signature is malformed")
+	}
+	for _, value := range trustedKeys {
+		key, err := ParsePublicKey(value)
+		if err != nil {
+			return err
+		}
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match any trusted key")
+}
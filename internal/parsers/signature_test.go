@@ -0,0 +1,71 @@
+package parsers
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+)
+
+// testKey returns a fixed key pair so failures are reproducible
+func testKey(seed byte) ed25519.PrivateKey {
+	s := make([]byte, ed25519.SeedSize)
+	for i := range s {
+		s[i] = seed
+	}
+	return ed25519.NewKeyFromSeed(s)
+}
+
+func TestVerifySignature(t *testing.T) {
+	manifest := []byte(`{"schema_version": 2, "name": "Pack", "version": "1.0"}`)
+	current, retired, stranger := testKey(1), testKey(2), testKey(3)
+	signature := SignData(current, manifest)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		signature []byte
+		keys      []string
+		valid     bool
+	}{
+		{name: "valid", data: manifest, signature: signature, keys: []string{PublicKeyOf(current)}, valid: true},
+		{name: "tampered manifest", data: []byte(`{"schema_version": 2, "name": "Pack", "version": "6.6"}`), signature: signature, keys: []string{PublicKeyOf(current)}},
+		{name: "wrong key", data: manifest, signature: signature, keys: []string{PublicKeyOf(stranger)}},
+		{name: "second trusted key", data: manifest, signature: signature, keys: []string{PublicKeyOf(retired), PublicKeyOf(current)}, valid: true},
+		{name: "signed by the retired key", data: manifest, signature: SignData(retired, manifest), keys: []string{PublicKeyOf(retired), PublicKeyOf(current)}, valid: true},
+		{name: "empty signature", data: manifest, signature: nil, keys: []string{PublicKeyOf(current)}},
+		{name: "malformed signature", data: manifest, signature: []byte("not base64!"), keys: []string{PublicKeyOf(current)}},
+		{name: "no trusted keys", data: manifest, signature: signature},
+		{name: "invalid trusted key", data: manifest, signature: signature, keys: []string{"c2hvcnQ="}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySignature(tt.data, tt.signature, tt.keys)
+			if (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pack.key")
+	public, err := GenerateKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PublicKeyOf(private) != public {
+		t.Errorf("loaded key belongs to %s, want %s", PublicKeyOf(private), public)
+	}
+	if _, err := GenerateKeyPair(path); err == nil {
+		t.Error("an existing key was overwritten")
+	}
+
+	data := []byte("resources")
+	if err := VerifySignature(data, SignData(private, data), []string{public}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,466 @@
+package parsers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	// SeverityError problems make the file unusable, nothing is done until they are fixed
+	SeverityError = "error"
+	// SeverityWarning problems are likely mistakes, but the file still works
+	SeverityWarning = "warning"
+)
+
+// Problem is something wrong with a field of a config or resources file
+type Problem struct {
+	Severity string `json:"severity"`
+	Field    string `json:"field"`            // path of the field, like folders[1].path, empty for the whole file
+	Line     int    `json:"line,omitempty"`   // 1-based position of the field in the file, 0 when unknown
+	Column   int    `json:"column,omitempty"` // 1-based, counted in bytes
+	Message  string `json:"message"`
+}
+
+// Format renders the problem the way compilers do, so editors can jump to it
+func (p Problem) Format(file string) string {
+	location := file
+	if p.Line > 0 {
+		location += fmt.Sprintf(":%d:%d", p.Line, p.Column)
+	}
+	if p.Field != "" {
+		return fmt.Sprintf("%s: %s: %s: %s", location, p.Severity, p.Field, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, p.Severity, p.Message)
+}
+
+// Problems is the result of a validation pass
+type Problems []Problem
+
+// HasErrors reports whether any of the problems is an error rather than a warning
+func (ps Problems) HasErrors() bool {
+	for _, p := range ps {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Log writes every problem to the log as an error or a warning
+func (ps Problems) Log(file string) {
+	for _, p := range ps {
+		if p.Severity == SeverityError {
+			utils.LogError(errors.New(p.Format(file)))
+		} else {
+			utils.LogWarning(p.Format(file))
+		}
+	}
+}
+
+// validator collects problems and finds where in the source they are
+type validator struct {
+	source   []byte
+	offsets  map[string]int
+	problems Problems
+}
+
+func newValidator(source []byte) *validator {
+	return &validator{source: source, offsets: fieldOffsets(source)}
+}
+
+func (v *validator) errorf(field, format string, args ...any) {
+	v.add(SeverityError, field, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) warnf(field, format string, args ...any) {
+	v.add(SeverityWarning, field, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) add(severity, field, message string) {
+	p := Problem{Severity: severity, Field: field, Message: message}
+	// a field left out of the file is reported where its parent is
+	for lookup := field; lookup != ""; lookup = parentFieldPath(lookup) {
+		if offset, ok := v.offsets[lookup]; ok {
+			p.Line, p.Column = lineColumn(v.source, offset)
+			break
+		}
+	}
+	v.problems = append(v.problems, p)
+}
+
+// unknownFields warns about every field of the decoded source that t does not have, usually a typo
+func (v *validator) unknownFields(doc any, t reflect.Type) {
+	for _, field := range unknownFields(doc, t, "") {
+		v.warnf(field, "unknown field, it is ignored")
+	}
+}
+
+// Validate checks the config for everything that would make a run fail or behave unexpectedly.
+// Only a config read by LoadConfig knows where its fields are in the file.
+func (c *Config) Validate() Problems {
+	v := newValidator(c.source)
+	var doc any
+	if json.Unmarshal(c.source, &doc) == nil {
+		v.unknownFields(doc, reflect.TypeOf(Config{}))
+	}
+
+	if strings.TrimSpace(c.Name) == "" {
+		v.warnf("name", "is empty, the window and resources.json will have no name")
+	}
+	if c.UpdateServer == "" {
+		v.errorf("update_server", "is empty, there is nowhere to check for updates")
+	} else if !isHTTPURL(c.UpdateServer) {
+		v.errorf("update_server", "%q is not an http or https URL", c.UpdateServer)
+	}
+	if c.PatchURL != "" && !isHTTPURL(c.PatchURL) {
+		v.errorf("patch_url", "%q is not an http or https URL", c.PatchURL)
+	}
+
+	if len(c.Folders) == 0 {
+		v.warnf("folders", "is empty, nothing will be kept up to date")
+	}
+	seenFolders := make(map[string]bool)
+	for i, folder := range c.Folders {
+		field := fmt.Sprintf("folders[%d]", i)
+		switch {
+		case strings.TrimSpace(folder.Path) == "":
+			v.errorf(field, "folder path is empty")
+		case !isSafeRelativePath(folder.Path):
+			v.errorf(field, "%q is outside the base directory", folder.Path)
+		}
+		if seenFolders[cleanFolderPath(folder.Path)] {
+			v.warnf(field, "%q is listed more than once", folder.Path)
+		}
+		seenFolders[cleanFolderPath(folder.Path)] = true
+
+		switch folder.Policy {
+		case FolderPolicySync, FolderPolicyMirror, FolderPolicyAdditive, FolderPolicySeedOnce:
+		default:
+			v.errorf(field+".policy", "unknown policy %q, expected %s, %s or %s", folder.Policy, FolderPolicyMirror, FolderPolicyAdditive, FolderPolicySeedOnce)
+		}
+		for j, pattern := range folder.Ignore {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.errorf(fmt.Sprintf("%s.ignore[%d]", field, j), "invalid pattern %q", pattern)
+			}
+		}
+	}
+	for i, prune := range c.PruneFolders {
+		if !isSafeRelativePath(prune) {
+			v.errorf(fmt.Sprintf("prune_folders[%d]", i), "%q is outside the base directory", prune)
+		}
+	}
+	if len(c.PruneFolders) > 0 {
+		v.warnf("prune_folders", "is deprecated, give the folders the mirror policy instead")
+	}
+
+	if c.StaleAction != StaleActionQuarantine && c.StaleAction != StaleActionDelete {
+		v.errorf("stale_action", "unknown action %q, expected %s or %s", c.StaleAction, StaleActionQuarantine, StaleActionDelete)
+	}
+	if c.Retry.MaxDelayMs < c.Retry.InitialDelayMs {
+		v.warnf("retry.max_delay_ms", "is shorter than initial_delay_ms")
+	}
+	if _, err := utils.ParseSize(c.DownloadRateLimit); err != nil {
+		v.errorf("download_rate_limit", "%v", err)
+	}
+	if _, err := utils.ParseSize(c.ConnectionRateLimit); err != nil {
+		v.errorf("connection_rate_limit", "%v", err)
+	}
+	if _, err := utils.ParseSize(c.Cache.MaxSize); err != nil {
+		v.errorf("cache.max_size", "%v", err)
+	}
+
+	seenGroups := make(map[string]bool)
+	for i, group := range c.Groups {
+		field := fmt.Sprintf("groups[%d]", i)
+		if group.Name == "" {
+			v.errorf(field+".name", "is empty")
+		} else if seenGroups[group.Name] {
+			v.errorf(field+".name", "group %q is defined more than once", group.Name)
+		}
+		seenGroups[group.Name] = true
+		if len(group.Files) == 0 {
+			v.warnf(field+".files", "is empty, the group has no content")
+		}
+		for j, pattern := range group.Files {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.errorf(fmt.Sprintf("%s.files[%d]", field, j), "invalid pattern %q", pattern)
+			}
+		}
+	}
+
+	if c.Launch != nil && strings.TrimSpace(c.Launch.Command) == "" {
+		v.errorf("launch.command", "is empty")
+	}
+	if c.Updater != nil {
+		v.validateRelease("updater", c.Updater)
+	}
+	for i, key := range c.TrustedKeys {
+		if _, err := ParsePublicKey(key); err != nil {
+			v.errorf(fmt.Sprintf("trusted_keys[%d]", i), "%v", err)
+		}
+	}
+	for i, name := range c.HashAlgorithms {
+		if _, err := utils.NewHasher(name); err != nil {
+			v.errorf(fmt.Sprintf("hash_algorithms[%d]", i), "%v", err)
+		}
+	}
+	return v.problems
+}
+
+func (v *validator) validateRelease(field string, release *Release) {
+	if release.Version == "" {
+		v.errorf(field+".version", "is empty")
+	}
+	for i, build := range release.Builds {
+		buildField := fmt.Sprintf("%s.builds[%d]", field, i)
+		if build.OS == "" || build.Arch == "" {
+			v.errorf(buildField, "needs both os and arch")
+		}
+		if !isHTTPURL(build.URL) {
+			v.errorf(buildField+".url", "%q is not an http or https URL", build.URL)
+		}
+		// a build that was not published yet has no hash, it is not offered until it does
+		if build.Checksum().IsZero() {
+			v.warnf(buildField+".hash", "is empty, this build is not offered to players until it has one")
+		}
+	}
+}
+
+// Validate checks the resource set for entries the updater cannot act on safely.
+// Only a resource set read by ParseResource or LoadResource knows where its fields are in the file.
+func (rs *ResourceSet) Validate() Problems {
+	v := newValidator(rs.source)
+	var doc map[string]any
+	if json.Unmarshal(rs.source, &doc) == nil && doc != nil {
+		// older layouts use other names for the same fields
+		if version, err := schemaVersionOf(doc); err == nil && version <= CurrentSchemaVersion {
+			upgradeManifest(doc, version)
+			v.unknownFields(doc, reflect.TypeOf(ResourceSet{}))
+		}
+	}
+
+	if rs.Name == "" {
+		v.warnf("name", "is empty")
+	}
+	if rs.LocalVersion == "" {
+		v.warnf("version", "is empty")
+	}
+
+	groups := make(map[string]bool, len(rs.Groups))
+	for _, group := range rs.Groups {
+		groups[group.Name] = true
+	}
+
+	seenPaths := make(map[string]bool, len(rs.Resources))
+	for i, r := range rs.Resources {
+		field := fmt.Sprintf("resources[%d]", i)
+		switch {
+		case r.Path == "":
+			v.errorf(field+".path", "is empty")
+		case !isSafeRelativePath(r.Path) || cleanFolderPath(r.Path) == ".":
+			v.errorf(field+".path", "%q is outside the base directory", r.Path)
+		case seenPaths[cleanFolderPath(r.Path)]:
+			v.errorf(field+".path", "%q is listed more than once", r.Path)
+		}
+		seenPaths[cleanFolderPath(r.Path)] = true
+
+		v.validateHashes(field, r.Hash, r.Hashes)
+		if r.Size < 0 {
+			v.errorf(field+".size", "is negative")
+		}
+		if len(r.DownloadURLs()) == 0 {
+			v.warnf(field+".url", "is empty, the file will be skipped")
+		}
+		if r.URL != "" && !isHTTPURL(r.URL) {
+			v.errorf(field+".url", "%q is not an http or https URL", r.URL)
+		}
+		for j, mirror := range r.Mirrors {
+			if !isHTTPURL(mirror.URL) {
+				v.errorf(fmt.Sprintf("%s.mirrors[%d].url", field, j), "%q is not an http or https URL", mirror.URL)
+			}
+		}
+		switch r.Side {
+		case "", SideClient, SideServer, SideBoth:
+		default:
+			v.errorf(field+".side", "unknown side %q, expected %s, %s or %s", r.Side, SideClient, SideServer, SideBoth)
+		}
+		switch r.Policy {
+		case FolderPolicySync, FolderPolicyMirror, FolderPolicyAdditive, FolderPolicySeedOnce:
+		default:
+			v.errorf(field+".policy", "unknown policy %q", r.Policy)
+		}
+		if r.Group != "" && !groups[r.Group] {
+			v.warnf(field+".group", "group %q is not declared, the file is always installed", r.Group)
+		}
+	}
+
+	for i, patch := range rs.Patches {
+		field := fmt.Sprintf("patches[%d]", i)
+		if !isHTTPURL(patch.URL) {
+			v.errorf(field+".url", "%q is not an http or https URL", patch.URL)
+		}
+		if patch.Size <= 0 {
+			v.warnf(field+".size", "is missing, the patch download cannot be checked")
+		}
+		if len(patch.Hashes) == 0 {
+			v.warnf(field+".hashes", "are missing, the patch download cannot be checked")
+		}
+		for name, value := range patch.Hashes {
+			if _, known := hexLengths[name]; known && !isHexHash(value, name) {
+				v.errorf(field+".hashes."+name, "%q is not a %s hash", value, name)
+			}
+		}
+	}
+	for i, tomb := range rs.Removed {
+		if !isSafeRelativePath(tomb.Path) || cleanFolderPath(tomb.Path) == "." {
+			v.errorf(fmt.Sprintf("removed[%d].path", i), "%q is outside the base directory", tomb.Path)
+		}
+	}
+	if rs.Updater != nil {
+		v.validateRelease("updater", rs.Updater)
+	}
+	return v.problems
+}
+
+// hexLengths is how many hex digits a hash of each algorithm has
+var hexLengths = map[string]int{utils.HashSHA1: 40, utils.HashSHA256: 64, utils.HashSHA512: 128}
+
+func (v *validator) validateHashes(field, sha1 string, hashes map[string]string) {
+	if sha1 == "" && len(hashes) == 0 {
+		v.warnf(field+".hash", "is empty, the file cannot be verified and is downloaded on every run")
+	}
+	if sha1 != "" && !isHexHash(sha1, utils.HashSHA1) {
+		v.errorf(field+".hash", "%q is not a sha1 hash", sha1)
+	}
+	for name, value := range hashes {
+		if _, known := hexLengths[name]; !known {
+			v.warnf(field+".hashes."+name, "unknown hash algorithm, it is ignored")
+		} else if !isHexHash(value, name) {
+			v.errorf(field+".hashes."+name, "%q is not a %s hash", value, name)
+		}
+	}
+}
+
+func isHexHash(value, algorithm string) bool {
+	if len(value) != hexLengths[algorithm] {
+		return false
+	}
+	for _, ch := range value {
+		if !strings.ContainsRune("0123456789abcdef", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isSafeRelativePath reports whether p stays inside the base directory on every platform
+func isSafeRelativePath(p string) bool {
+	clean := cleanFolderPath(p)
+	if clean == ".." || strings.HasPrefix(clean, "../") || strings.HasPrefix(clean, "/") || filepath.IsAbs(p) {
+		return false
+	}
+	// a drive letter is absolute on Windows even when we are not running there
+	return !(len(clean) >= 2 && clean[1] == ':')
+}
+
+// fieldOffsets maps the path of every value in the JSON document, in the form used by Problem.Field,
+// to the offset where its key or array element starts
+func fieldOffsets(data []byte) map[string]int {
+	offsets := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var walk func(field string) error
+	walk = func(field string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := tok.(json.Delim)
+		if !ok {
+			return nil
+		}
+		switch delim {
+		case '{':
+			for dec.More() {
+				start := skipJSONSeparators(data, int(dec.InputOffset()))
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				name, _ := key.(string)
+				child := joinFieldPath(field, name)
+				offsets[child] = start
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for i := 0; dec.More(); i++ {
+				child := fmt.Sprintf("%s[%d]", field, i)
+				offsets[child] = skipJSONSeparators(data, int(dec.InputOffset()))
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		// the closing delimiter
+		_, err = dec.Token()
+		return err
+	}
+	_ = walk("")
+	return offsets
+}
+
+// skipJSONSeparators moves offset past whitespace and the punctuation between two values
+func skipJSONSeparators(data []byte, offset int) int {
+	for offset < len(data) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// parentFieldPath strips the last key or index from a field path
+func parentFieldPath(field string) string {
+	if i := strings.LastIndexAny(field, ".["); i >= 0 {
+		return field[:i]
+	}
+	return ""
+}
+
+// lineColumn turns a byte offset into a 1-based line and column
+func lineColumn(data []byte, offset int) (int, int) {
+	offset = min(offset, len(data))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// jsonError adds the position in file to a syntax or type error from decoding data
+func jsonError(file string, data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, column := lineColumn(data, int(syntaxErr.Offset))
+		return fmt.Errorf("%s:%d:%d: %v", file, line, column, err)
+	case errors.As(err, &typeErr):
+		line, column := lineColumn(data, int(typeErr.Offset))
+		return fmt.Errorf("%s:%d:%d: %s: expected %s, got %s", file, line, column, typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return fmt.Errorf("%s: %v", file, err)
+}
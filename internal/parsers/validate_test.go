@@ -0,0 +1,172 @@
+package parsers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// position is a line and column, both starting at 1
+type position struct {
+	line, column int
+}
+
+func TestFieldOffsets(t *testing.T) {
+	data := []byte(`{
+  "name": "Pack",
+  "resources": [
+    {"path": "mods/a.jar"},
+    {
+      "path": "mods/b.jar",
+      "mirrors": [{"url": "https://example.com/b.jar"}]
+    }
+  ]
+}`)
+
+	offsets := fieldOffsets(data)
+	tests := map[string]position{
+		"name":                        {2, 3},
+		"resources":                   {3, 3},
+		"resources[0]":                {4, 5},
+		"resources[0].path":           {4, 6},
+		"resources[1]":                {5, 5},
+		"resources[1].path":           {6, 7},
+		"resources[1].mirrors[0]":     {7, 19},
+		"resources[1].mirrors[0].url": {7, 20},
+	}
+	for field, want := range tests {
+		offset, ok := offsets[field]
+		if !ok {
+			t.Errorf("%s: no offset", field)
+			continue
+		}
+		line, column := lineColumn(data, offset)
+		if line != want.line || column != want.column {
+			t.Errorf("%s at %d:%d, want %d:%d", field, line, column, want.line, want.column)
+		}
+	}
+}
+
+func TestResourceSetProblemPositions(t *testing.T) {
+	data := `{
+  "schema_version": 2,
+  "name": "Pack",
+  "version": "1.0",
+  "resources": [
+    {"path": "mods/ok.jar", "hash": "da39a3ee5e6b4b0d3255bfef95601890afd80709", "url": "https://example.com/ok.jar"},
+    {
+      "path": "../outside.jar",
+      "hash": "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+      "url": "ftp://example.com/outside.jar",
+      "side": "sideways"
+    },
+    {"path": "mods/nohash.jar", "url": "https://example.com/nohash.jar"}
+  ]
+}`
+	rs, err := ParseResource([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]position{
+		"resources[1].path": {8, 7},
+		"resources[1].url":  {10, 7},
+		"resources[1].side": {11, 7},
+		// a field that is left out is reported where its parent starts
+		"resources[2].hash": {13, 5},
+	}
+	found := make(map[string]bool)
+	for _, p := range rs.Validate() {
+		pos, ok := want[p.Field]
+		if !ok {
+			continue
+		}
+		found[p.Field] = true
+		if p.Line != pos.line || p.Column != pos.column {
+			t.Errorf("%s reported at %d:%d, want %d:%d", p.Field, p.Line, p.Column, pos.line, pos.column)
+		}
+	}
+	for field := range want {
+		if !found[field] {
+			t.Errorf("no problem reported for %s", field)
+		}
+	}
+}
+
+func TestUppercaseHashes(t *testing.T) {
+	data := `{
+  "schema_version": 2,
+  "name": "Pack",
+  "version": "1.0",
+  "resources": [{
+    "path": "mods/a.jar",
+    "hash": "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709",
+    "hashes": {"sha256": "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855"},
+    "url": "https://example.com/a.jar"
+  }]
+}`
+	rs, err := ParseResource([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := rs.Validate(); problems.HasErrors() {
+		t.Errorf("uppercase hashes rejected: %+v", problems)
+	}
+	if checksum := rs.Resources[0].Checksum(); checksum.Value != strings.ToLower(checksum.Value) {
+		t.Errorf("hash %q was not normalized to lowercase", checksum.Value)
+	}
+}
+
+func TestUnpublishedUpdaterBuild(t *testing.T) {
+	// the state of an updater build before it was published: no hash and no size yet
+	path := filepath.Join(t.TempDir(), "cargodrop.json")
+	data := `{
+  "name": "Pack",
+  "update_server": "https://example.com/resources.json",
+  "updater": {
+    "version": "1.1",
+    "builds": [{"os": "windows", "arch": "amd64", "url": "https://example.com/cargodrop.exe", "hash": "", "size": 0}]
+  }
+}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := config.Validate()
+	if problems.HasErrors() {
+		t.Errorf("unpublished build is an error: %+v", problems)
+	}
+	for _, p := range problems {
+		if p.Field == "updater.builds[0].hash" {
+			if p.Line != 6 || p.Column != 95 {
+				t.Errorf("hash reported at %d:%d, want 6:95", p.Line, p.Column)
+			}
+			return
+		}
+	}
+	t.Error("no warning for the missing hash")
+}
+
+func TestDemoFilesValidate(t *testing.T) {
+	dir := filepath.Join("..", "..", "cmd", "demofiles")
+	config, err := LoadConfig(filepath.Join(dir, "cargodrop.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range config.Validate() {
+		t.Error(p.Format("cargodrop.json"))
+	}
+
+	resources, err := LoadResource(filepath.Join(dir, "resources.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range resources.Validate() {
+		t.Error(p.Format("resources.json"))
+	}
+}
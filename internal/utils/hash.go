@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Names of the supported hash algorithms as they appear in configs and manifests
+const (
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+)
+
+// HashAlgorithms lists the supported hash algorithms from the weakest to the strongest
+var HashAlgorithms = []string{HashSHA1, HashSHA256, HashSHA512}
+
+// NewHasher returns a fresh hash.Hash for the algorithm called name
+func NewHasher(name string) (hash.Hash, error) {
+	switch name {
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", name)
+}
+
+// HashFile hashes the file with every one of algorithms in a single pass over its content.
+// The result maps each algorithm name to its hex encoded hash.
+func HashFile(filePath string, algorithms ...string) (map[string]string, error) {
+	hashers := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, name := range algorithms {
+		if _, seen := hashers[name]; seen {
+			continue
+		}
+		h, err := NewHasher(name)
+		if err != nil {
+			return nil, err
+		}
+		hashers[name] = h
+		writers = append(writers, h)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			LogError(fmt.Errorf("failed to close file %s: %v", filePath, closeErr))
+		}
+	}()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string, len(hashers))
+	for name, h := range hashers {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
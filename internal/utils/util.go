@@ -1,11 +1,12 @@
 package utils
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func FormatSize(size int64) string {
@@ -26,22 +27,54 @@ func FormatSize(size int64) string {
 	}
 }
 
-// GenerateSHA1 generates SHA1 hash for a file
-func GenerateSHA1(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+// ParseSize parses sizes such as "512K", "2 MB", "1.5GiB" or "1048576" into bytes.
+// Units are 1024 based like FormatSize, an empty string is 0.
+func ParseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
 	}
-	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
-			LogError(fmt.Errorf("failed to close file %s: %v", filePath, closeErr))
-		}
-	}()
+	s = strings.TrimSuffix(s, "/S")
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
 
-	hash := sha1.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
 	}
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	number, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// CopyFile copies src to dst, creating the parent folders of dst
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
 }
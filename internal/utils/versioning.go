@@ -24,3 +24,33 @@ func IncrementVersion(version string) string {
 	parts[lastIdx] = strconv.Itoa(lastPart + 1)
 	return strings.Join(parts, ".")
 }
+
+// CompareVersions compares two dotted version strings part by part, numerically where both parts are numbers.
+// It returns -1 when a is older than b, 1 when it is newer and 0 when they are the same.
+// Examples: "1.9" < "1.10", "1.0" == "1.0.0"
+func CompareVersions(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < max(len(partsA), len(partsB)); i++ {
+		partA, partB := "0", "0"
+		if i < len(partsA) {
+			partA = partsA[i]
+		}
+		if i < len(partsB) {
+			partB = partsB[i]
+		}
+
+		numA, errA := strconv.Atoi(partA)
+		numB, errB := strconv.Atoi(partB)
+		switch {
+		case errA == nil && errB == nil && numA != numB:
+			if numA < numB {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && partA != partB:
+			return strings.Compare(partA, partB)
+		}
+	}
+	return 0
+}
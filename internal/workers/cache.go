@@ -0,0 +1,266 @@
+package workers
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	cacheObjectsDir = "objects"
+	// cacheUsedSuffix marks when a cached file was last used, without touching the cached file itself
+	cacheUsedSuffix = ".used"
+	cacheTempSuffix = ".tmp"
+)
+
+// contentCache is a store of downloaded files keyed by their strongest hash, shared by every instance on the computer.
+// A nil *contentCache is valid and never has anything.
+type contentCache struct {
+	dir       string
+	maxSize   int64
+	hardlinks bool
+}
+
+// openContentCache returns the cache described by config, or nil when the cache is disabled or unusable
+func openContentCache(config *parsers.Config) *contentCache {
+	if !config.Cache.Enabled {
+		return nil
+	}
+	cache, err := newContentCache(config)
+	if err != nil {
+		utils.LogWarning("Download cache is not available: " + err.Error())
+		return nil
+	}
+	return cache
+}
+
+func newContentCache(config *parsers.Config) (*contentCache, error) {
+	dir := config.Cache.Dir
+	if dir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(userCache, "cargodrop")
+	}
+
+	maxSize, err := utils.ParseSize(config.Cache.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("cache max_size: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, cacheObjectsDir), 0755); err != nil {
+		return nil, err
+	}
+	return &contentCache{dir: dir, maxSize: maxSize, hardlinks: config.Cache.Hardlinks}, nil
+}
+
+// objectPath is where the file with the given checksum lives in the cache, objects/<algorithm>/<prefix>/<hash>
+func (c *contentCache) objectPath(checksum parsers.Checksum) string {
+	return filepath.Join(c.dir, cacheObjectsDir, checksum.Algorithm, checksum.Value[:2], checksum.Value)
+}
+
+// validCacheChecksum keeps a checksum from the manifest from escaping the cache folder
+func validCacheChecksum(checksum parsers.Checksum) bool {
+	if !slices.Contains(utils.HashAlgorithms, checksum.Algorithm) || len(checksum.Value) < 8 {
+		return false
+	}
+	for _, ch := range checksum.Value {
+		if !strings.ContainsRune("0123456789abcdef", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// place puts the cached copy of r at dst and reports whether it was there.
+// The copy is hashed again before it is used, a damaged cache entry is thrown away.
+func (c *contentCache) place(r parsers.Resource, dst string) bool {
+	checksum := r.Checksum()
+	if c == nil || !validCacheChecksum(checksum) {
+		return false
+	}
+	src := c.objectPath(checksum)
+	if _, err := os.Stat(src); err != nil {
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		utils.LogError(err)
+		return false
+	}
+	_ = os.Remove(dst)
+	method, err := c.link(src, dst)
+	if err != nil {
+		utils.LogWarning("Failed to use the cached copy of " + r.Path + ": " + err.Error())
+		return false
+	}
+
+	if err := verifyChecksum(dst, checksum); err != nil {
+		utils.LogWarning("Cached copy of " + r.Path + " is damaged, downloading it again.")
+		_ = os.Remove(dst)
+		_ = os.Remove(src)
+		_ = os.Remove(src + cacheUsedSuffix)
+		return false
+	}
+
+	c.markUsed(checksum)
+	utils.LogMessage("Using cached copy of " + filepath.Base(r.Path) + " (" + method + ")")
+	return true
+}
+
+// store adds the verified file at src to the cache under checksum
+func (c *contentCache) store(checksum parsers.Checksum, src string) {
+	if c == nil || !validCacheChecksum(checksum) {
+		return
+	}
+	dst := c.objectPath(checksum)
+	if _, err := os.Stat(dst); err == nil {
+		c.markUsed(checksum)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		utils.LogError(err)
+		return
+	}
+	// another instance may be storing the same file right now, only a complete file gets the final name
+	tmp := fmt.Sprintf("%s.%d%s", dst, os.Getpid(), cacheTempSuffix)
+	if _, err := c.link(src, tmp); err != nil {
+		utils.LogWarning("Failed to add " + filepath.Base(src) + " to the download cache: " + err.Error())
+		_ = os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		utils.LogError(err)
+		_ = os.Remove(tmp)
+		return
+	}
+	c.markUsed(checksum)
+}
+
+func (c *contentCache) markUsed(checksum parsers.Checksum) {
+	marker := c.objectPath(checksum) + cacheUsedSuffix
+	now := time.Now()
+	if err := os.Chtimes(marker, now, now); os.IsNotExist(err) {
+		_ = os.WriteFile(marker, nil, 0644)
+	}
+}
+
+// cacheObject is a file in the cache along with when it was last used
+type cacheObject struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// gc removes leftover temporary files and evicts the least recently used files until the cache fits maxSize.
+// It returns how many files were removed and how many bytes that freed.
+func (c *contentCache) gc() (int, int64, error) {
+	var objects []cacheObject
+	var total int64
+	removed := 0
+	var freed int64
+
+	err := filepath.WalkDir(filepath.Join(c.dir, cacheObjectsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, cacheUsedSuffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(path, cacheTempSuffix) {
+			// only clean up temp files that nobody can still be writing
+			if time.Since(info.ModTime()) > time.Hour && os.Remove(path) == nil {
+				removed++
+				freed += info.Size()
+			}
+			return nil
+		}
+
+		obj := cacheObject{path: path, size: info.Size(), lastUsed: info.ModTime()}
+		if used, err := os.Stat(path + cacheUsedSuffix); err == nil {
+			obj.lastUsed = used.ModTime()
+		}
+		objects = append(objects, obj)
+		total += obj.size
+		return nil
+	})
+	if err != nil {
+		return removed, freed, err
+	}
+
+	if c.maxSize <= 0 || total <= c.maxSize {
+		return removed, freed, nil
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].lastUsed.Before(objects[j].lastUsed)
+	})
+	for _, obj := range objects {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(obj.path); err != nil {
+			utils.LogError(err)
+			continue
+		}
+		_ = os.Remove(obj.path + cacheUsedSuffix)
+		total -= obj.size
+		freed += obj.size
+		removed++
+	}
+	return removed, freed, nil
+}
+
+// GarbageCollectCache shrinks the shared download cache of config down to its max size
+func GarbageCollectCache(config *parsers.Config) error {
+	cache, err := newContentCache(config)
+	if err != nil {
+		return err
+	}
+
+	utils.LogMessage("Cleaning up the download cache in " + cache.dir + " ...")
+	removed, freed, err := cache.gc()
+	if err != nil {
+		return err
+	}
+	utils.LogMessage(fmt.Sprintf("Removed %d files, freed %s.", removed, utils.FormatSize(freed)))
+	return nil
+}
+
+// link places src at dst with a hardlink when the config opted into them, or else with reflinkOrCopy.
+// Hardlinks are opt-in, a file the player edits in place would change the cache and every instance using it.
+func (c *contentCache) link(src, dst string) (string, error) {
+	if c.hardlinks {
+		if err := os.Link(src, dst); err == nil {
+			return "hardlink", nil
+		}
+	}
+	return reflinkOrCopy(src, dst)
+}
+
+// reflinkOrCopy places src at dst as cheaply as the file system allows without sharing later changes:
+// a reflink shares the data but not later changes, and a copy works everywhere. It returns what was used.
+func reflinkOrCopy(src, dst string) (string, error) {
+	if err := reflinkFile(src, dst); err == nil {
+		return "reflink", nil
+	}
+	_ = os.Remove(dst)
+	if err := utils.CopyFile(src, dst); err != nil {
+		return "", err
+	}
+	return "copy", nil
+}
@@ -0,0 +1,109 @@
+package workers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+func testCache(t *testing.T, hardlinks bool) *contentCache {
+	t.Helper()
+	cache, err := newContentCache(&parsers.Config{Cache: parsers.CacheConfig{Enabled: true, Dir: t.TempDir(), Hardlinks: hardlinks}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// sha256Resource returns a resource published with only a sha256 hash of content
+func sha256Resource(path string, content []byte) parsers.Resource {
+	sum := sha256.Sum256(content)
+	return parsers.Resource{Path: path, Hashes: map[string]string{utils.HashSHA256: hex.EncodeToString(sum[:])}}
+}
+
+func TestCacheKeysByStrongestHash(t *testing.T) {
+	cache := testCache(t, false)
+	dir := t.TempDir()
+	content := []byte("only published with sha256")
+	r := sha256Resource("mods/a.jar", content)
+	r.Hash = "da39a3ee5e6b4b0d3255bfef95601890afd80709" // a sha1 that does not matter next to the sha256
+	src := filepath.Join(dir, "downloaded.jar")
+	writeTestFile(t, src, string(content))
+
+	cache.store(r.Checksum(), src)
+	object := filepath.Join(cache.dir, cacheObjectsDir, utils.HashSHA256, r.Hashes[utils.HashSHA256][:2], r.Hashes[utils.HashSHA256])
+	if _, err := os.Stat(object); err != nil {
+		t.Fatalf("not stored under its sha256: %v", err)
+	}
+
+	dst := filepath.Join(dir, "instance", "a.jar")
+	if !cache.place(r, dst) {
+		t.Fatal("stored file was not placed")
+	}
+	assertTree(t, dir, map[string]string{"instance/a.jar": string(content)})
+}
+
+func TestCachePlaceRejectsDamagedObjects(t *testing.T) {
+	cache := testCache(t, false)
+	dir := t.TempDir()
+	r := sha256Resource("mods/a.jar", []byte("original"))
+	writeTestFile(t, cache.objectPath(r.Checksum()), "damaged")
+
+	if cache.place(r, filepath.Join(dir, "a.jar")) {
+		t.Fatal("damaged cache object was placed")
+	}
+	if _, err := os.Stat(cache.objectPath(r.Checksum())); err == nil {
+		t.Error("damaged cache object was kept")
+	}
+	assertTree(t, dir, map[string]string{"a.jar": ""})
+}
+
+func TestCacheHardlinksAreOptIn(t *testing.T) {
+	for _, hardlinks := range []bool{false, true} {
+		cache := testCache(t, hardlinks)
+		dir := t.TempDir()
+		content := []byte("shared")
+		r := sha256Resource("mods/a.jar", content)
+		writeTestFile(t, filepath.Join(dir, "downloaded.jar"), string(content))
+		cache.store(r.Checksum(), filepath.Join(dir, "downloaded.jar"))
+
+		dst := filepath.Join(dir, "a.jar")
+		if !cache.place(r, dst) {
+			t.Fatal("stored file was not placed")
+		}
+		objectInfo, err := os.Stat(cache.objectPath(r.Checksum()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		placedInfo, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linked := os.SameFile(objectInfo, placedInfo); linked != hardlinks {
+			t.Errorf("hardlinks %v: placed file shares the cached file: %v", hardlinks, linked)
+		}
+	}
+}
+
+func TestValidCacheChecksum(t *testing.T) {
+	tests := []struct {
+		checksum parsers.Checksum
+		valid    bool
+	}{
+		{parsers.Checksum{Algorithm: utils.HashSHA1, Value: "da39a3ee5e6b4b0d3255bfef95601890afd80709"}, true},
+		{parsers.Checksum{Algorithm: "md5", Value: "d41d8cd98f00b204e9800998ecf8427e"}, false},
+		{parsers.Checksum{Algorithm: utils.HashSHA256, Value: "../../../etc/passwd"}, false},
+		{parsers.Checksum{Algorithm: utils.HashSHA256, Value: "abc"}, false},
+		{parsers.Checksum{}, false},
+	}
+	for _, tt := range tests {
+		if got := validCacheChecksum(tt.checksum); got != tt.valid {
+			t.Errorf("validCacheChecksum(%+v) = %v, want %v", tt.checksum, got, tt.valid)
+		}
+	}
+}
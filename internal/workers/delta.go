@@ -0,0 +1,297 @@
+package workers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Deltas describe a new file as a list of ranges copied from the old file and literal data.
+// The old file is split into fixed blocks which are looked up with a rolling checksum, the same
+// idea rsync uses, and every match is extended as far as both files agree.
+//
+// File layout (gzip compressed): magic, target size, then ops until deltaOpEnd
+//
+//	deltaOpCopy: uvarint offset, uvarint length   - copy from the old file
+//	deltaOpData: uvarint length, bytes            - literal bytes
+const (
+	deltaMagic     = "CDDELTA1"
+	deltaBlockSize = 2048
+	// maxDeltaInput keeps the generator from loading huge files into memory
+	maxDeltaInput = 512 * 1024 * 1024
+)
+
+const (
+	deltaOpEnd byte = iota
+	deltaOpCopy
+	deltaOpData
+)
+
+var errDeltaCorrupt = errors.New("delta patch is corrupt")
+
+// rollingSum is the rsync weak checksum over a window of deltaBlockSize bytes
+type rollingSum struct {
+	a, b uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	var s rollingSum
+	n := uint32(len(window))
+	for i, c := range window {
+		s.a += uint32(c)
+		s.b += (n - uint32(i)) * uint32(c)
+	}
+	return s
+}
+
+func (s *rollingSum) roll(out, in byte) {
+	s.a = s.a - uint32(out) + uint32(in)
+	s.b = s.b - deltaBlockSize*uint32(out) + s.a
+}
+
+func (s rollingSum) digest() uint32 {
+	return (s.a & 0xffff) | (s.b << 16)
+}
+
+// deltaWriter encodes ops into the gzip stream
+type deltaWriter struct {
+	zw  *gzip.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *deltaWriter) uvarint(v uint64) error {
+	n := binary.PutUvarint(w.buf[:], v)
+	_, err := w.zw.Write(w.buf[:n])
+	return err
+}
+
+func (w *deltaWriter) copyOp(offset, length int) error {
+	if _, err := w.zw.Write([]byte{deltaOpCopy}); err != nil {
+		return err
+	}
+	if err := w.uvarint(uint64(offset)); err != nil {
+		return err
+	}
+	return w.uvarint(uint64(length))
+}
+
+func (w *deltaWriter) dataOp(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := w.zw.Write([]byte{deltaOpData}); err != nil {
+		return err
+	}
+	if err := w.uvarint(uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.zw.Write(data)
+	return err
+}
+
+// createDelta writes a patch that turns oldPath into newPath to patchPath
+func createDelta(oldPath, newPath, patchPath string) error {
+	oldData, err := readDeltaInput(oldPath)
+	if err != nil {
+		return err
+	}
+	newData, err := readDeltaInput(newPath)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(patchPath)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	w := &deltaWriter{zw: zw}
+
+	err = encodeDelta(w, oldData, newData)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(patchPath)
+	}
+	return err
+}
+
+func readDeltaInput(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxDeltaInput {
+		return nil, fmt.Errorf("%s is too large to create a delta patch", path)
+	}
+	return os.ReadFile(path)
+}
+
+func encodeDelta(w *deltaWriter, oldData, newData []byte) error {
+	if _, err := w.zw.Write([]byte(deltaMagic)); err != nil {
+		return err
+	}
+	if err := w.uvarint(uint64(len(newData))); err != nil {
+		return err
+	}
+
+	// index every aligned block of the old file by its weak checksum
+	blocks := make(map[uint32][]int)
+	for off := 0; off+deltaBlockSize <= len(oldData); off += deltaBlockSize {
+		sum := newRollingSum(oldData[off : off+deltaBlockSize]).digest()
+		blocks[sum] = append(blocks[sum], off)
+	}
+
+	literalStart := 0
+	i := 0
+	var sum rollingSum
+	if len(newData) >= deltaBlockSize {
+		sum = newRollingSum(newData[:deltaBlockSize])
+	}
+
+	for len(blocks) > 0 && i+deltaBlockSize <= len(newData) {
+		matchOff := -1
+		for _, off := range blocks[sum.digest()] {
+			if bytes.Equal(oldData[off:off+deltaBlockSize], newData[i:i+deltaBlockSize]) {
+				matchOff = off
+				break
+			}
+		}
+
+		if matchOff < 0 {
+			if i+deltaBlockSize < len(newData) {
+				sum.roll(newData[i], newData[i+deltaBlockSize])
+			}
+			i++
+			continue
+		}
+
+		// grow the match for as long as both files agree
+		length := deltaBlockSize
+		for matchOff+length < len(oldData) && i+length < len(newData) && oldData[matchOff+length] == newData[i+length] {
+			length++
+		}
+
+		if err := w.dataOp(newData[literalStart:i]); err != nil {
+			return err
+		}
+		if err := w.copyOp(matchOff, length); err != nil {
+			return err
+		}
+
+		i += length
+		literalStart = i
+		if i+deltaBlockSize <= len(newData) {
+			sum = newRollingSum(newData[i : i+deltaBlockSize])
+		}
+	}
+
+	if err := w.dataOp(newData[literalStart:]); err != nil {
+		return err
+	}
+	_, err := w.zw.Write([]byte{deltaOpEnd})
+	return err
+}
+
+// applyDelta rebuilds the new file at outPath from oldPath and the patch at patchPath.
+// A patch that claims to produce more than maxSize bytes is rejected before anything is written.
+func applyDelta(oldPath, patchPath, outPath string, maxSize int64) error {
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = oldFile.Close() }()
+
+	patchFile, err := os.Open(patchPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = patchFile.Close() }()
+
+	zr, err := gzip.NewReader(patchFile)
+	if err != nil {
+		return errDeltaCorrupt
+	}
+	r := bufio.NewReader(zr)
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return errDeltaCorrupt
+	}
+	targetSize, err := binary.ReadUvarint(r)
+	if err != nil || targetSize > uint64(maxSize) {
+		return errDeltaCorrupt
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(out)
+
+	err = decodeDelta(r, oldFile, bw, int64(targetSize))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(outPath)
+	}
+	return err
+}
+
+// decodeDelta writes the ops of r to w, no op may take the output past targetSize
+func decodeDelta(r *bufio.Reader, oldFile *os.File, w io.Writer, targetSize int64) error {
+	var written int64
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return errDeltaCorrupt
+		}
+
+		switch op {
+		case deltaOpEnd:
+			if written != targetSize {
+				return fmt.Errorf("delta patch produced %d bytes, expected %d", written, targetSize)
+			}
+			return nil
+		case deltaOpCopy:
+			offset, err1 := binary.ReadUvarint(r)
+			length, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || length > uint64(targetSize-written) {
+				return errDeltaCorrupt
+			}
+			n, err := io.Copy(w, io.NewSectionReader(oldFile, int64(offset), int64(length)))
+			if err != nil {
+				return err
+			}
+			if n != int64(length) {
+				return errDeltaCorrupt
+			}
+			written += n
+		case deltaOpData:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(targetSize-written) {
+				return errDeltaCorrupt
+			}
+			n, err := io.CopyN(w, r, int64(length))
+			if err != nil {
+				return errDeltaCorrupt
+			}
+			written += n
+		default:
+			return errDeltaCorrupt
+		}
+	}
+}
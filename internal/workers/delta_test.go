@@ -0,0 +1,157 @@
+package workers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// randomBytes returns n reproducible pseudo random bytes
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundtrip creates a delta from oldData to newData, applies it and returns the result and the patch size
+func roundtrip(t *testing.T, oldData, newData []byte) ([]byte, int64) {
+	t.Helper()
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	patchPath := filepath.Join(dir, "patch")
+	outPath := filepath.Join(dir, "out")
+	if err := os.WriteFile(oldPath, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createDelta(oldPath, newPath, patchPath); err != nil {
+		t.Fatalf("createDelta: %v", err)
+	}
+	if err := applyDelta(oldPath, patchPath, outPath, int64(len(newData))); err != nil {
+		t.Fatalf("applyDelta: %v", err)
+	}
+	out, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(patchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, info.Size()
+}
+
+func TestDeltaRoundtrip(t *testing.T) {
+	base := randomBytes(1, 20*deltaBlockSize)
+	edited := append([]byte(nil), base...)
+	// one edit right on a block boundary and one straddling the next
+	copy(edited[4*deltaBlockSize:], "boundary")
+	copy(edited[9*deltaBlockSize-3:], "straddle")
+
+	tests := []struct {
+		name     string
+		old, new []byte
+		small    bool // the patch should be much smaller than the new file
+	}{
+		{name: "empty files", old: nil, new: nil},
+		{name: "empty old file", old: nil, new: randomBytes(2, 3000)},
+		{name: "empty new file", old: base, new: nil},
+		{name: "identical", old: base, new: base, small: true},
+		{name: "append", old: base, new: concat(base, randomBytes(3, 5000)), small: true},
+		{name: "prepend", old: base, new: concat(randomBytes(4, 777), base), small: true},
+		{name: "block boundary edits", old: base, new: edited, small: true},
+		{name: "truncated to a block", old: base, new: base[:deltaBlockSize], small: true},
+		{name: "shorter than a block", old: base, new: base[:deltaBlockSize-1]},
+		{name: "unrelated", old: base, new: randomBytes(5, len(base))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, patchSize := roundtrip(t, tt.old, tt.new)
+			if !bytes.Equal(out, tt.new) {
+				t.Fatalf("patched file differs from the new file (%d bytes, want %d)", len(out), len(tt.new))
+			}
+			if tt.small && patchSize > int64(len(tt.new))/4+1024 {
+				t.Errorf("patch is %d bytes for a %d byte file", patchSize, len(tt.new))
+			}
+		})
+	}
+}
+
+// writePatch writes a raw delta stream, gzip compressed like createDelta does
+func writePatch(t *testing.T, path string, raw []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyDeltaRejectsCorruptPatches(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	if err := os.WriteFile(oldPath, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	header := []byte(deltaMagic)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		gzipped bool
+		maxSize int64
+		sizeErr bool // rejected for producing the wrong size rather than as corrupt
+	}{
+		{name: "not gzip", raw: []byte("garbage")},
+		{name: "wrong magic", raw: []byte("CDDELTA0\x00\x00"), gzipped: true, maxSize: 10},
+		{name: "no end op", raw: concat(header, []byte{4, deltaOpData, 4}, []byte("abcd")), gzipped: true, maxSize: 10},
+		{name: "unknown op", raw: concat(header, []byte{1, 9}), gzipped: true, maxSize: 10},
+		{name: "copy past the old file", raw: concat(header, []byte{4, deltaOpCopy, 8, 4, deltaOpEnd}), gzipped: true, maxSize: 10},
+		{name: "data longer than the patch", raw: concat(header, []byte{8, deltaOpData, 8}, []byte("abc")), gzipped: true, maxSize: 10},
+		{name: "output past target size", raw: concat(header, []byte{2, deltaOpCopy, 0, 8, deltaOpEnd}), gzipped: true, maxSize: 10},
+		{name: "short output", raw: concat(header, []byte{8, deltaOpCopy, 0, 4, deltaOpEnd}), gzipped: true, maxSize: 10, sizeErr: true},
+		{name: "target over max size", raw: concat(header, []byte{11, deltaOpCopy, 0, 10, deltaOpData, 1, 'x', deltaOpEnd}), gzipped: true, maxSize: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patchPath := filepath.Join(dir, "patch")
+			outPath := filepath.Join(dir, "out")
+			if tt.gzipped {
+				writePatch(t, patchPath, tt.raw)
+			} else if err := os.WriteFile(patchPath, tt.raw, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyDelta(oldPath, patchPath, outPath, tt.maxSize)
+			if err == nil {
+				t.Fatal("corrupt patch was applied")
+			}
+			if _, statErr := os.Stat(outPath); statErr == nil {
+				t.Error("output of a failed patch was left behind")
+			}
+			if !tt.sizeErr && !errors.Is(err, errDeltaCorrupt) {
+				t.Errorf("got %v, want %v", err, errDeltaCorrupt)
+			}
+		})
+	}
+}
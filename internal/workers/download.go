@@ -0,0 +1,335 @@
+package workers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	partSuffix      = ".part"
+	partStateSuffix = ".part.json"
+)
+
+// partState is saved next to a .part file so an interrupted download can be resumed on the next launch
+type partState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// validator returns the value to send in If-Range, weak ETags are not allowed there
+func (s *partState) validator() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+func loadPartState(path string) *partState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var state partState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	return &state
+}
+
+func savePartState(path string, state *partState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// resumeOffset returns how many bytes of a previous attempt can be reused for url, 0 means start over
+func resumeOffset(partPath string, state *partState, url string) int64 {
+	if state == nil || state.URL != url || state.validator() == "" {
+		return 0
+	}
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// hashPart feeds the bytes of a previous attempt into h, so a resumed download is still hashed as a whole
+func hashPart(partPath string, h hash.Hash) error {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// checksumHasher returns the hasher a download is streamed through, sha1 when there is nothing to check
+func checksumHasher(expected parsers.Checksum) (hash.Hash, error) {
+	if expected.IsZero() {
+		return utils.NewHasher(utils.HashSHA1)
+	}
+	return utils.NewHasher(expected.Algorithm)
+}
+
+// DownloadFile downloads a file and reports progress, the download is aborted once ctx is cancelled.
+// Data is written to a sidecar .part file which is only moved to localPath once complete, so an
+// interrupted transfer is resumed with a Range request the next time the same file is downloaded.
+// The file is hashed while it streams in, and it is only moved into place when it matches expectedSize
+// and expected (either can be left empty to skip the check) and is as long as the server announced.
+func DownloadFile(ctx context.Context, url, localPath, fileName string, expectedSize int64, expected parsers.Checksum, progressCb func(fileName string, downloadedBytes, totalBytes int64)) error {
+	return downloadFile(ctx, url, localPath, fileName, expectedSize, expected, progressCb, false)
+}
+
+// downloadFile is DownloadFile, restarted is set once the partial file was thrown away so it is only done once
+func downloadFile(ctx context.Context, url, localPath, fileName string, expectedSize int64, expected parsers.Checksum, progressCb func(fileName string, downloadedBytes, totalBytes int64), restarted bool) error {
+	utils.LogMessage("Downloading " + fileName + " (" + utils.FormatSize(expectedSize) + ") ...")
+
+	dir := filepath.Dir(localPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		utils.LogError(err)
+		return err
+	}
+
+	partPath := localPath + partSuffix
+	statePath := localPath + partStateSuffix
+	state := loadPartState(statePath)
+	offset := resumeOffset(partPath, state, url)
+	if expectedSize > 0 && offset >= expectedSize {
+		// a complete (or oversized) part that was never accepted, it cannot be the right file
+		discardPart(localPath)
+		offset = 0
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		utils.LogError(err)
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", state.validator())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		utils.LogError(err)
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			utils.LogError(err)
+		}
+	}()
+
+	var out *os.File
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp) == offset:
+		utils.LogMessage("Resuming " + fileName + " from " + utils.FormatSize(offset))
+		out, err = os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0644)
+	case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == 0:
+		// either a fresh download, or the server ignored our range / the file changed upstream
+		if offset > 0 {
+			utils.LogWarning("Server did not resume " + fileName + ", downloading it again from the start.")
+		}
+		offset = 0
+		out, err = os.Create(partPath)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable, resp.StatusCode == http.StatusPartialContent:
+		// the partial file is no longer valid for this resource, throw it away and start over
+		discardPart(localPath)
+		if restarted || offset == 0 {
+			return fmt.Errorf("download of %s failed, server answered %s to a request for the whole file", fileName, resp.Status)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		utils.LogWarning("Partial download of " + fileName + " is no longer valid, restarting.")
+		return downloadFile(ctx, url, localPath, fileName, expectedSize, expected, progressCb, true)
+	default:
+		utils.LogWarning("Download failed " + url + ": " + resp.Status)
+		return newHTTPStatusError(url, resp)
+	}
+	if err != nil {
+		utils.LogError(err)
+		return err
+	}
+
+	// the announced length has to add up with the manifest before we spend any bandwidth on it
+	announced := int64(-1)
+	if resp.ContentLength >= 0 {
+		announced = offset + resp.ContentLength
+	}
+	if expectedSize > 0 && announced >= 0 && announced != expectedSize {
+		_ = out.Close()
+		discardPart(localPath)
+		return &sizeMismatchError{File: fileName, Expected: expectedSize, Actual: announced}
+	}
+
+	hasher, err := checksumHasher(expected)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	if offset > 0 {
+		if err := hashPart(partPath, hasher); err != nil {
+			utils.LogError(err)
+			_ = out.Close()
+			discardPart(localPath)
+			return err
+		}
+	}
+
+	// remember how to resume this download before any data hits the disk
+	err = savePartState(statePath, &partState{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if err != nil {
+		utils.LogError(err)
+	}
+
+	totalBytes := expectedSize
+	downloadedBytes := offset
+	connLimiter := newConnectionLimiter()
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			// honour the bandwidth limits before taking the next chunk off the wire
+			if err := downloadLimiter.wait(ctx, n); err != nil {
+				_ = out.Close()
+				return err
+			}
+			if err := connLimiter.wait(ctx, n); err != nil {
+				_ = out.Close()
+				return err
+			}
+
+			wn, writeErr := out.Write(buf[:n])
+			if writeErr != nil {
+				utils.LogError(writeErr)
+				_ = out.Close()
+				return writeErr
+			}
+			hasher.Write(buf[:wn])
+			downloadedBytes += int64(wn)
+			if expectedSize > 0 && downloadedBytes > expectedSize {
+				_ = out.Close()
+				discardPart(localPath)
+				return &sizeMismatchError{File: fileName, Expected: expectedSize, Actual: downloadedBytes}
+			}
+			if progressCb != nil {
+				progressCb(fileName, downloadedBytes, totalBytes)
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				utils.LogError(readErr)
+				_ = out.Close()
+				return readErr
+			}
+			break
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		utils.LogError(err)
+		return err
+	}
+
+	// nothing is accepted unless it is exactly what was announced and what the manifest lists
+	if announced >= 0 && downloadedBytes < announced {
+		// keep the part, the next attempt picks up where this one was cut off
+		return fmt.Errorf("download of %s ended after %d of %d bytes", fileName, downloadedBytes, announced)
+	}
+	if expectedSize > 0 && downloadedBytes != expectedSize {
+		discardPart(localPath)
+		return &sizeMismatchError{File: fileName, Expected: expectedSize, Actual: downloadedBytes}
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); !expected.IsZero() && actual != expected.Value {
+		discardPart(localPath)
+		return &hashMismatchError{File: fileName, Algorithm: expected.Algorithm, Expected: expected.Value, Actual: actual}
+	}
+
+	if err := os.Rename(partPath, localPath); err != nil {
+		utils.LogError(err)
+		return err
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		utils.LogError(err)
+	}
+	return nil
+}
+
+// downloadResource downloads r to localPath, retrying each location according to policy and failing
+// over to the next mirror of r when a location keeps erroring out or serves a file that does not match the manifest.
+func downloadResource(ctx context.Context, policy retryPolicy, hosts *hostLimiter, r parsers.Resource, localPath string, progressCb func(fileName string, downloadedBytes, totalBytes int64)) error {
+	filename := filepath.Base(r.Path)
+	urls := r.DownloadURLs()
+	if len(urls) == 0 {
+		return fmt.Errorf("no download URL for %s", r.Path)
+	}
+
+	var lastErr error
+	for i, url := range urls {
+		if i > 0 {
+			utils.LogWarning("Trying mirror " + strconv.Itoa(i) + " for " + filename + ": " + url)
+		}
+
+		err := policy.do(ctx, "Download of "+filename+" from "+url, func() error {
+			return hosts.fetch(ctx, url, func() error {
+				return DownloadFile(ctx, url, localPath, filename, r.Size, r.Checksum(), progressCb)
+			})
+		})
+		if err == nil {
+			utils.LogMessage("Downloaded " + filename + " from " + url)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		lastErr = err
+	}
+	return fmt.Errorf("all %d download locations failed for %s, last error: %v", len(urls), filename, lastErr)
+}
+
+// contentRangeStart returns the first byte position of a "Content-Range: bytes start-end/size" header, or -1
+func contentRangeStart(resp *http.Response) int64 {
+	value := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	dash := strings.IndexByte(value, '-')
+	if dash <= 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(value[:dash], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// discardPart removes any leftover partial download of localPath
+func discardPart(localPath string) {
+	for _, path := range []string{localPath + partSuffix, localPath + partStateSuffix} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			utils.LogError(err)
+		}
+	}
+}
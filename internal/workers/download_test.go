@@ -0,0 +1,176 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// rangeServer serves content with the given ETag and records the Range and If-Range headers of every request
+type rangeServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	ranges   []string
+	ifRanges []string
+}
+
+func newRangeServer(t *testing.T, content []byte, etag string, handle func(w http.ResponseWriter, r *http.Request) bool) *rangeServer {
+	s := &rangeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.ifRanges = append(s.ifRanges, r.Header.Get("If-Range"))
+		s.mu.Unlock()
+		if handle != nil && handle(w, r) {
+			return
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func sha1Checksum(data []byte) parsers.Checksum {
+	sum := sha1.Sum(data)
+	return parsers.Checksum{Algorithm: utils.HashSHA1, Value: hex.EncodeToString(sum[:])}
+}
+
+// leavePart sets up a partial download of url at localPath, as an interrupted attempt leaves it behind
+func leavePart(t *testing.T, localPath, url string, data []byte, etag string) {
+	t.Helper()
+	if err := os.WriteFile(localPath+partSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePartState(localPath+partStateSuffix, &partState{URL: url, ETag: etag}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertDownloaded(t *testing.T, localPath string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("downloaded %d bytes that differ from the %d byte file", len(got), len(want))
+	}
+	for _, leftover := range []string{localPath + partSuffix, localPath + partStateSuffix} {
+		if _, err := os.Stat(leftover); err == nil {
+			t.Errorf("%s was left behind", filepath.Base(leftover))
+		}
+	}
+}
+
+func TestDownloadResumesAfterAnInterruption(t *testing.T) {
+	content := randomBytes(10, 64*1024)
+	half := len(content) / 2
+	first := true
+	server := newRangeServer(t, content, `"v1"`, func(w http.ResponseWriter, r *http.Request) bool {
+		if !first {
+			return false
+		}
+		// announce the whole file, then drop the connection halfway through
+		first = false
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write(content[:half])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	localPath := filepath.Join(t.TempDir(), "file.jar")
+	size := int64(len(content))
+
+	if err := DownloadFile(context.Background(), server.URL, localPath, "file.jar", size, sha1Checksum(content), nil); err == nil {
+		t.Fatal("interrupted download succeeded")
+	}
+	if info, err := os.Stat(localPath + partSuffix); err != nil || info.Size() != int64(half) {
+		t.Fatalf("partial download was not kept: %v", err)
+	}
+
+	if err := DownloadFile(context.Background(), server.URL, localPath, "file.jar", size, sha1Checksum(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	assertDownloaded(t, localPath, content)
+	if want := "bytes=" + strconv.Itoa(half) + "-"; server.ranges[1] != want || server.ifRanges[1] != `"v1"` {
+		t.Errorf("resumed with Range %q If-Range %q, want %q and %q", server.ranges[1], server.ifRanges[1], want, `"v1"`)
+	}
+}
+
+func TestDownloadRestartsWhenThePartCannotBeResumed(t *testing.T) {
+	content := randomBytes(11, 64*1024)
+	half := len(content) / 2
+
+	tests := []struct {
+		name     string
+		part     []byte
+		partETag string
+		handle   func(w http.ResponseWriter, r *http.Request) bool
+		requests int
+	}{
+		{
+			name:     "server ignores Range",
+			part:     content[:half],
+			partETag: `"v1"`,
+			handle: func(w http.ResponseWriter, r *http.Request) bool {
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write(content)
+				return true
+			},
+			requests: 1,
+		},
+		{
+			// If-Range no longer matches, so the server sends the new file in full
+			name:     "file changed upstream",
+			part:     randomBytes(12, half),
+			partETag: `"v0"`,
+			requests: 1,
+		},
+		{
+			name:     "range not satisfiable",
+			part:     content[:half],
+			partETag: `"v1"`,
+			handle: func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Header.Get("Range") == "" {
+					return false
+				}
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return true
+			},
+			requests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newRangeServer(t, content, `"v1"`, tt.handle)
+			localPath := filepath.Join(t.TempDir(), "file.jar")
+			leavePart(t, localPath, server.URL, tt.part, tt.partETag)
+
+			err := DownloadFile(context.Background(), server.URL, localPath, "file.jar", int64(len(content)), sha1Checksum(content), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertDownloaded(t, localPath, content)
+			if len(server.ranges) != tt.requests {
+				t.Errorf("%d requests, want %d", len(server.ranges), tt.requests)
+			}
+			if server.ranges[0] == "" || server.ifRanges[0] != tt.partETag {
+				t.Errorf("first request did not try to resume: Range %q If-Range %q", server.ranges[0], server.ifRanges[0])
+			}
+		})
+	}
+}
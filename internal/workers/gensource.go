@@ -1,10 +1,12 @@
 package workers
 
 import (
+	"crypto/ed25519"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 
@@ -13,7 +15,7 @@ import (
 	"github.com/cosmiclabstudio/cargodrop/internal/utils"
 )
 
-func RunGenSourceSequence(config *parsers.Config, resources *parsers.ResourceSet, baseDir string, resourcesPath string, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error), isServiceModrinth bool) {
+func RunGenSourceSequence(config *parsers.Config, resources *parsers.ResourceSet, baseDir string, resourcesPath string, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error), isServiceModrinth bool) error {
 	// some introduction
 	utils.LogRaw(utils.GetFullVersionString())
 	utils.LogRaw("By using this software, you agree to the Terms of Conditions and the License of this program.")
@@ -28,101 +30,215 @@ func RunGenSourceSequence(config *parsers.Config, resources *parsers.ResourceSet
 		utils.LogMessage("Using Modrinth Provider.")
 	}
 
+	// Load the key before the long scan, a typo in the config should not cost a full run
+	var signingKey ed25519.PrivateKey
+	if config.SigningKey != "" {
+		key, err := parsers.LoadPrivateKey(config.SigningKey)
+		if err != nil {
+			utils.LogError(err)
+			errorCb("Failed to load the signing key.", err)
+			return err
+		}
+		signingKey = key
+		utils.LogMessage("Signing with public key: " + parsers.PublicKeyOf(key))
+	} else if len(config.TrustedKeys) > 0 {
+		utils.LogWarning("The config trusts signing keys but has no signing_key, players will refuse this resources.json.")
+	}
+
+	// Patches are written next to resources.json and have to be uploaded to config.PatchURL
+	patchDir := filepath.Join(filepath.Dir(resourcesPath), "patches")
+	var newPatches []parsers.Patches
+	if config.PatchURL != "" {
+		utils.LogMessage("Generating patches into: " + patchDir)
+	}
+
 	utils.LogMessage("Please wait...")
 
 	utils.LogMessage("Scanning folders: " + fmt.Sprintf("%v", config.Folders))
 
 	newResources := &parsers.ResourceSet{
-		Name:         config.Name,                                    // Copy from config
-		LocalVersion: utils.IncrementVersion(resources.LocalVersion), // Increment version
-		Resources:    []parsers.Resource{},
+		SchemaVersion: parsers.CurrentSchemaVersion,
+		Name:          config.Name,                                    // Copy from config
+		LocalVersion:  utils.IncrementVersion(resources.LocalVersion), // Increment version
+		Resources:     []parsers.Resource{},
 	}
+	for _, group := range config.Groups {
+		newResources.Groups = append(newResources.Groups, group.Group)
+	}
+	newResources.Updater = config.Updater
 
 	existingResources := make(map[string]*parsers.Resource)
 	for i, resource := range resources.Resources {
-		existingResources[resource.Path] = &resources.Resources[i]
+		existingResources[normalizePath(resource.Path)] = &resources.Resources[i]
 	}
+	addedResources := make(map[string]bool)
+	modrinthSides := make(projectSides)
 
 	totalFiles := 0
 	for _, folder := range config.Folders {
-		folderPath := filepath.Join(baseDir, folder)
+		folderPath := filepath.Join(baseDir, folder.Path)
 		err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if !info.IsDir() {
+			if skipWalkEntry(fs.FileInfoToDirEntry(info)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && !isIgnoredFile(config, baseDir, path) {
 				totalFiles++
 			}
 			return nil
 		})
 		if err != nil {
-			utils.LogError(fmt.Errorf("failed to scan folder %s: %v", folder, err))
-			errorCb("Failed to scan folder "+folder, err)
-			return
+			utils.LogError(fmt.Errorf("failed to scan folder %s: %v", folder.Path, err))
+			errorCb("Failed to scan folder "+folder.Path, err)
+			return err
 		}
 	}
 
 	processedFiles := 0
 	for _, folder := range config.Folders {
-		folderPath := filepath.Join(baseDir, folder)
-		utils.LogMessage("Processing folder: " + folder)
+		folderPath := filepath.Join(baseDir, folder.Path)
+		utils.LogMessage("Processing folder: " + folder.String())
 
 		err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
 
+			if skipWalkEntry(fs.FileInfoToDirEntry(info)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
 			if info.IsDir() {
 				return nil
 			}
 
+			// Paths are always stored relative to baseDir with forward slashes
+			relPath, err := filepath.Rel(baseDir, path)
+			if err != nil {
+				return err
+			}
+			resourcePath := normalizePath(relPath)
+			if addedResources[resourcePath] {
+				// folders overlap, this file was already added
+				return nil
+			}
+			if config.IsIgnored(resourcePath) {
+				utils.LogMessage("Ignoring: " + resourcePath)
+				return nil
+			}
+
 			filename := info.Name()
 			progressCb(filename, 0, info.Size(), processedFiles, totalFiles)
 			utils.LogMessage("Processing: " + filename + " (" + utils.FormatSize(info.Size()) + ")")
 
-			// Generate SHA1 hash
-			hash, err := utils.GenerateSHA1(path)
+			// sha1 is always there for Modrinth and older clients, the configured ones come from the same read
+			sums, err := utils.HashFile(path, append([]string{utils.HashSHA1}, config.HashAlgorithms...)...)
 			if err != nil {
 				utils.LogError(fmt.Errorf("failed to generate hash for %s: %v", filename, err))
 				return err
 			}
+			hash := sums[utils.HashSHA1]
+			delete(sums, utils.HashSHA1)
+			if len(sums) == 0 {
+				sums = nil
+			}
 
 			// just in case we want to use other provider
-			url, err := "", nil
+			url, side := "", ""
 
 			if isServiceModrinth {
-				url, err = api.GetModrinthURL(hash, filename)
+				version, err := api.LookupModrinthVersion(hash)
 				if err != nil {
-					utils.LogError(fmt.Errorf("", filename, err))
+					utils.LogError(fmt.Errorf("failed to look up %s on modrinth: %v", filename, err))
 					return err
 				}
+				if version != nil {
+					url = version.FileURL(filename)
+					side = modrinthSides.lookup(version.ProjectID)
+				}
 			}
 
 			// Create resource entry
 			resource := parsers.Resource{
-				Path: filepath.Join(folder, filename),
-				Hash: hash,
-				Size: info.Size(),
-				URL:  url,
+				Path:   resourcePath,
+				Hash:   hash,
+				Hashes: sums,
+				Size:   info.Size(),
+				URL:    url,
+				Side:   side,
+				// the most specific folder wins when folders are nested
+				Policy: config.PolicyFor(resourcePath),
+				Group:  config.GroupFor(resourcePath),
 			}
 
 			// Preserve existing URL if it exists, only when there is actual text
-			resourcePath := filepath.Join(folder, filename)
-			if existing, exists := existingResources[resourcePath]; exists && len(resourcePath) > 0 {
+			if existing, exists := existingResources[resourcePath]; exists && len(existing.URL) > 0 {
 				resource.URL = existing.URL
 			}
+			// Mirrors are maintained by hand, keep them across generations
+			if existing, exists := existingResources[resourcePath]; exists {
+				resource.Mirrors = existing.Mirrors
+			}
+			// so is a side that was set by hand, Modrinth only fills in the blanks
+			if existing, exists := existingResources[resourcePath]; exists && existing.Side != "" {
+				resource.Side = existing.Side
+			}
+
+			if config.PatchURL != "" {
+				// Diff against the previously published version of this file
+				if existing, exists := existingResources[resourcePath]; exists && existing.Hash != "" && existing.Hash != hash {
+					patch, err := generatePatch(baseDir, patchDir, config.PatchURL, config.HashAlgorithms, resource, existing.Hash, resources.LocalVersion, path)
+					if err != nil {
+						utils.LogWarning("Unable to create a patch for " + filename + ": " + err.Error())
+					} else if patch != nil {
+						utils.LogMessage("Created patch for " + filename + " (" + utils.FormatSize(patch.Size) + ")")
+						newPatches = append(newPatches, *patch)
+					}
+				}
+				if err := publishBlob(baseDir, path, hash); err != nil {
+					utils.LogWarning("Unable to keep a copy of " + filename + " for future patches: " + err.Error())
+				}
+			}
 
 			newResources.Resources = append(newResources.Resources, resource)
+			addedResources[resourcePath] = true
 			processedFiles++
 			progressCb(filename, info.Size(), info.Size(), processedFiles, totalFiles)
 			return nil
 		})
 
 		if err != nil {
-			utils.LogError(fmt.Errorf("failed to process folder %s: %v", folder, err))
-			errorCb("Failed to process folder "+folder, err)
-			return
+			utils.LogError(fmt.Errorf("failed to process folder %s: %v", folder.Path, err))
+			errorCb("Failed to process folder "+folder.Path, err)
+			return err
+		}
+	}
+
+	// Keep the patches that still lead to the current version of their file
+	if config.PatchURL != "" {
+		newResources.Patches = prunePatches(append(resources.Patches, newPatches...), newResources.Resources)
+		if err := prunePublished(baseDir, newResources.Patches, newResources.Resources); err != nil {
+			utils.LogWarning("Unable to clean up old published files: " + err.Error())
 		}
+		utils.LogMessage("Total patches: " + fmt.Sprintf("%d", len(newResources.Patches)))
+	}
+
+	// Leave a tombstone for everything that was dropped, so players get rid of it too
+	for _, tomb := range buildTombstones(resources, addedResources) {
+		if !config.IsIgnored(tomb.Path) {
+			newResources.Removed = append(newResources.Removed, tomb)
+		}
+	}
+	if len(newResources.Removed) > 0 {
+		utils.LogMessage("Removed resources: " + fmt.Sprintf("%d", len(newResources.Removed)))
 	}
 
 	// Generate resource set hash
@@ -133,7 +249,17 @@ func RunGenSourceSequence(config *parsers.Config, resources *parsers.ResourceSet
 	if err != nil {
 		utils.LogError(fmt.Errorf("failed to save resources.json: %v", err))
 		errorCb("Failed to save resources.json", err)
-		return
+		return err
+	}
+
+	// The signature covers the exact bytes on disk and has to be uploaded next to resources.json
+	if signingKey != nil {
+		if err := signResourceSet(signingKey, resourcesPath); err != nil {
+			utils.LogError(fmt.Errorf("failed to sign resources.json: %v", err))
+			errorCb("Failed to sign resources.json", err)
+			return err
+		}
+		utils.LogMessage("Signature written to: " + resourcesPath + parsers.SignatureSuffix)
 	}
 
 	progressCb("", 0, 0, totalFiles, totalFiles)
@@ -142,6 +268,7 @@ func RunGenSourceSequence(config *parsers.Config, resources *parsers.ResourceSet
 	utils.LogMessage("Total resources: " + fmt.Sprintf("%d", len(newResources.Resources)))
 	utils.LogMessage("Saved to: " + resourcesPath)
 	utils.LogMessage("Done!")
+	return nil
 }
 
 // generateResourceSetHash generates a hash for the entire resource set
@@ -153,6 +280,56 @@ func generateResourceSetHash(resources *parsers.ResourceSet) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
+// projectSides remembers the side of every Modrinth project already looked up, many files share a project
+type projectSides map[string]string
+
+// lookup returns the side of the Modrinth project, or "" when it cannot be found out
+func (s projectSides) lookup(projectID string) string {
+	if projectID == "" {
+		return ""
+	}
+	if side, ok := s[projectID]; ok {
+		return side
+	}
+
+	side := ""
+	project, err := api.GetModrinthProject(projectID)
+	if err != nil {
+		utils.LogWarning("Unable to get the side of modrinth project " + projectID + ": " + err.Error())
+	} else if project != nil {
+		side = project.Side()
+		utils.LogMessage(project.Title + " is installed on: " + side)
+	}
+	s[projectID] = side
+	return side
+}
+
+// buildTombstones lists every path of the previous set that is not part of the new one. Older tombstones are not
+// carried over: players who skipped that release still lose the file through the set they applied last, so the
+// tombstone is only needed for the one release and the list does not grow with every release.
+func buildTombstones(previous *parsers.ResourceSet, added map[string]bool) []parsers.Tombstone {
+	var tombstones []parsers.Tombstone
+	seen := make(map[string]bool)
+	for _, r := range previous.Resources {
+		path := normalizePath(r.Path)
+		if added[path] || seen[path] {
+			continue
+		}
+		seen[path] = true
+		tombstones = append(tombstones, parsers.Tombstone{Path: path, Hash: r.Hash})
+	}
+	return tombstones
+}
+
+// signResourceSet writes the detached signature of the resources file at path next to it
+func signResourceSet(key ed25519.PrivateKey, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+parsers.SignatureSuffix, parsers.SignData(key, data), 0644)
+}
+
 // saveResourceSet saves the resource set to a JSON file
 func saveResourceSet(resources *parsers.ResourceSet, outputPath string) error {
 	data, err := json.MarshalIndent(resources, "", "  ")
@@ -0,0 +1,29 @@
+package workers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+)
+
+func TestBuildTombstones(t *testing.T) {
+	previous := &parsers.ResourceSet{
+		Resources: []parsers.Resource{
+			{Path: "mods/kept.jar", Hash: "aa"},
+			{Path: "mods/dropped.jar", Hash: "bb"},
+			{Path: `config\dropped.toml`, Hash: "cc"},
+		},
+		// dropped a release earlier, the applied set of every player already covers it
+		Removed: []parsers.Tombstone{{Path: "mods/ancient.jar", Hash: "dd"}},
+	}
+	added := map[string]bool{"mods/kept.jar": true}
+
+	want := []parsers.Tombstone{
+		{Path: "mods/dropped.jar", Hash: "bb"},
+		{Path: "config/dropped.toml", Hash: "cc"},
+	}
+	if got := buildTombstones(previous, added); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
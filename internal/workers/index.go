@@ -0,0 +1,165 @@
+package workers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// hashIndexVersion is bumped whenever the index format changes, older indexes are thrown away
+const hashIndexVersion = 2
+
+// indexEntry is what we knew about a file the last time it was hashed, with every hash worked out for it by algorithm
+type indexEntry struct {
+	Size   int64             `json:"size"`
+	MTime  int64             `json:"mtime"`
+	Inode  uint64            `json:"inode,omitempty"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+type hashIndexFile struct {
+	Version int                   `json:"version"`
+	Entries map[string]indexEntry `json:"entries"`
+}
+
+// HashIndex remembers the hash of every file under baseDir along with its size, mtime and inode,
+// so files that did not change since the last launch do not have to be hashed again.
+// A nil *HashIndex is valid and simply hashes every file.
+type HashIndex struct {
+	baseDir    string
+	fullVerify bool
+
+	mu      sync.Mutex
+	entries map[string]indexEntry
+}
+
+func hashIndexPath(baseDir string) string {
+	return filepath.Join(stateDir(baseDir), "index.json")
+}
+
+// LoadHashIndex reads the index of baseDir. A missing, corrupt or outdated index starts out empty.
+// With fullVerify every lookup hashes the file again, the results are still written back to the index.
+func LoadHashIndex(baseDir string, fullVerify bool) *HashIndex {
+	index := &HashIndex{baseDir: baseDir, fullVerify: fullVerify, entries: make(map[string]indexEntry)}
+
+	data, err := os.ReadFile(hashIndexPath(baseDir))
+	if err != nil {
+		return index
+	}
+
+	var file hashIndexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		utils.LogWarning("Hash index is corrupt, every file will be checked again.")
+		return index
+	}
+	if file.Version != hashIndexVersion || file.Entries == nil {
+		utils.LogWarning("Hash index is from another version, every file will be checked again.")
+		return index
+	}
+
+	index.entries = file.Entries
+	return index
+}
+
+// Hash returns the hash of path (relative to baseDir) with algorithm, using the cached value when the file is unchanged
+func (x *HashIndex) Hash(path, algorithm string) (string, error) {
+	key := normalizePath(path)
+	localPath := filepath.Join(x.baseDir, key)
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	if !x.fullVerify {
+		x.mu.Lock()
+		entry, ok := x.entries[key]
+		x.mu.Unlock()
+		if hash := entry.Hashes[algorithm]; ok && hash != "" && entry.matches(info) {
+			return hash, nil
+		}
+	}
+
+	sums, err := utils.HashFile(localPath, algorithm)
+	if err != nil {
+		return "", err
+	}
+	x.store(key, info, parsers.Checksum{Algorithm: algorithm, Value: sums[algorithm]})
+	return sums[algorithm], nil
+}
+
+// IsFullVerify reports whether cached hashes are being ignored
+func (x *HashIndex) IsFullVerify() bool {
+	return x != nil && x.fullVerify
+}
+
+// Record stores a hash we already know for path, e.g. right after a verified download was committed
+func (x *HashIndex) Record(path string, checksum parsers.Checksum) {
+	if x == nil || checksum.IsZero() {
+		return
+	}
+	key := normalizePath(path)
+	info, err := os.Stat(filepath.Join(x.baseDir, key))
+	if err != nil {
+		return
+	}
+	x.store(key, info, checksum)
+}
+
+// Forget drops path from the index
+func (x *HashIndex) Forget(path string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, normalizePath(path))
+}
+
+// Save writes the index back to disk
+func (x *HashIndex) Save() error {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	data, err := json.Marshal(hashIndexFile{Version: hashIndexVersion, Entries: x.entries})
+	x.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(hashIndexPath(x.baseDir), data)
+}
+
+// store adds checksum to the entry of key. The hashes of other algorithms are kept as long as the file did not change.
+func (x *HashIndex) store(key string, info os.FileInfo, checksum parsers.Checksum) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, ok := x.entries[key]
+	if known := entry.Hashes[checksum.Algorithm]; !ok || !entry.matches(info) || entry.Hashes == nil || known != "" && known != checksum.Value {
+		entry = indexEntry{
+			Size:   info.Size(),
+			MTime:  info.ModTime().UnixNano(),
+			Inode:  fileInode(info),
+			Hashes: make(map[string]string),
+		}
+	}
+	entry.Hashes[checksum.Algorithm] = checksum.Value
+	x.entries[key] = entry
+}
+
+func (e indexEntry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.MTime == info.ModTime().UnixNano() && e.Inode == fileInode(info)
+}
+
+// hashFile hashes path relative to baseDir with algorithm, through index when there is one
+func hashFile(index *HashIndex, baseDir, path, algorithm string) (string, error) {
+	if index == nil {
+		sums, err := utils.HashFile(filepath.Join(baseDir, path), algorithm)
+		return sums[algorithm], err
+	}
+	return index.Hash(path, algorithm)
+}
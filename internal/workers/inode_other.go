@@ -0,0 +1,10 @@
+//go:build !unix
+
+package workers
+
+import "os"
+
+// fileInode is not available here, size and mtime have to be enough
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package workers
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of info, so a file replaced by another one with the same size and mtime is noticed
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package workers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// LaunchStatus values for ${status} in the launch command
+const (
+	LaunchAfterSuccess = "success"
+	LaunchAfterFailure = "failure"
+)
+
+// LaunchVars returns the values the launch command can use as ${name}
+func LaunchVars(config *parsers.Config, baseDir, resourcePath, side, status string) map[string]string {
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		absBase = baseDir
+	}
+	version := ""
+	// the update rewrote the applied set, read the version we ended up with
+	if applied, err := parsers.LoadResource(resourcePath); err == nil {
+		version = applied.LocalVersion
+	}
+	return map[string]string{
+		"base_dir": absBase,
+		"version":  version,
+		"name":     config.Name,
+		"side":     side,
+		"status":   status,
+	}
+}
+
+// expandLaunch fills in ${name} from vars, anything else is looked up in the environment
+func expandLaunch(value string, vars map[string]string) string {
+	return os.Expand(value, func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if name == selfUpdatedEnv {
+			return ""
+		}
+		return os.Getenv(name)
+	})
+}
+
+// LaunchLogFile is where the output of the launch command goes when there is no terminal to show it in
+const LaunchLogFile = "launch.log"
+
+// RunLaunchCommand starts the launch command of config and waits for it. Its output goes straight to stdout
+// and stderr, only the command line and how it exited end up in our log: a chatty game would flood it.
+// It returns the exit code of the command, or an error when it could not be started at all.
+func RunLaunchCommand(launch *parsers.LaunchConfig, vars map[string]string, stdout, stderr io.Writer) (int, error) {
+	command := expandLaunch(launch.Command, vars)
+	if strings.TrimSpace(command) == "" {
+		return -1, errors.New("launch command is empty")
+	}
+	args := make([]string, len(launch.Args))
+	for i, arg := range launch.Args {
+		args[i] = expandLaunch(arg, vars)
+	}
+
+	cmd := exec.Command(command, args...)
+	cmd.Dir = vars["base_dir"]
+	if launch.Dir != "" {
+		cmd.Dir = expandLaunch(launch.Dir, vars)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = launchEnv()
+
+	utils.LogMessage("Launching: " + strings.Join(append([]string{command}, args...), " "))
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("failed to launch %s: %v", command, err)
+	}
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		utils.LogMessage(filepath.Base(command) + " exited normally.")
+		return 0, nil
+	case errors.As(err, &exitErr):
+		utils.LogWarning(fmt.Sprintf("%s exited with status %d.", filepath.Base(command), exitErr.ExitCode()))
+		return exitErr.ExitCode(), nil
+	default:
+		return -1, err
+	}
+}
+
+// launchEnv is our environment without the variables that only mean something to cargodrop itself
+func launchEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, selfUpdatedEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,55 @@
+package workers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+func TestRunLaunchCommandKeepsOutputOutOfTheLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	var logged []string
+	utils.RegisterGuiLogCallback(func(line string) { logged = append(logged, line) })
+	defer utils.RegisterGuiLogCallback(nil)
+	t.Setenv(selfUpdatedEnv, "1")
+
+	output := filepath.Join(t.TempDir(), LaunchLogFile)
+	logFile, err := os.Create(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = logFile.Close() }()
+
+	launch := &parsers.LaunchConfig{Command: "sh", Args: []string{"-c", `printf '%s-%s\n' game ${name}; echo "marker=$` + selfUpdatedEnv + `" >&2; exit 3`}}
+	code, err := RunLaunchCommand(launch, map[string]string{"name": "Pack", "base_dir": t.TempDir()}, logFile, logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Errorf("exit code %d, want 3", code)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("game-Pack")) || !bytes.Contains(data, []byte("marker=\n")) {
+		t.Errorf("unexpected game output %q", data)
+	}
+	for _, line := range logged {
+		if strings.Contains(line, "game-Pack") {
+			t.Errorf("game output ended up in the log: %q", line)
+		}
+	}
+	if len(logged) != 2 {
+		t.Errorf("logged %q, want only the command and its exit status", logged)
+	}
+}
@@ -0,0 +1,231 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	patchSuffix = ".cddelta"
+	// maxPatchChain is how many patches in a row the updater applies before a full download is simpler
+	maxPatchChain = 5
+	// a patch is only published when it is clearly smaller than the file it produces
+	maxPatchRatio = 0.8
+)
+
+// publishedDir keeps a copy of every published file on the generator side, keyed by hash,
+// so the next generation still has the old version around to diff against.
+func publishedDir(baseDir string) string {
+	return filepath.Join(stateDir(baseDir), "published")
+}
+
+// publishBlob stores the file at path in the published folder under its hash
+func publishBlob(baseDir, path, hash string) error {
+	dst := filepath.Join(publishedDir(baseDir), hash)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	return utils.CopyFile(path, dst)
+}
+
+// generatePatch creates a delta from the published oldHash to the file at newPath.
+// It returns nil when the old version is not available or the patch would not save enough.
+func generatePatch(baseDir, patchDir, patchURL string, algorithms []string, resource parsers.Resource, oldHash, oldVersion, newPath string) (*parsers.Patches, error) {
+	oldPath := filepath.Join(publishedDir(baseDir), oldHash)
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(patchDir, 0755); err != nil {
+		return nil, err
+	}
+	name := oldHash + "_" + resource.Hash + patchSuffix
+	patchPath := filepath.Join(patchDir, name)
+	if err := createDelta(oldPath, newPath, patchPath); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(patchPath)
+	if err != nil {
+		return nil, err
+	}
+	if float64(info.Size()) >= float64(resource.Size)*maxPatchRatio {
+		_ = os.Remove(patchPath)
+		return nil, nil
+	}
+	sums, err := utils.HashFile(patchPath, algorithms...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsers.Patches{
+		Version:  oldVersion,
+		URL:      strings.TrimSuffix(patchURL, "/") + "/" + name,
+		Path:     resource.Path,
+		FromHash: oldHash,
+		ToHash:   resource.Hash,
+		Size:     info.Size(),
+		Hashes:   sums,
+	}, nil
+}
+
+// prunePatches keeps the patches that still lead to the current hash of their resource,
+// at most maxPatchChain per path with the newest ones winning.
+func prunePatches(patches []parsers.Patches, resources []parsers.Resource) []parsers.Patches {
+	current := make(map[string]string, len(resources))
+	for _, r := range resources {
+		current[normalizePath(r.Path)] = r.Hash
+	}
+
+	// walk backwards from the current hash of every path, newest patches are at the end
+	reachable := make(map[string]map[string]bool)
+	kept := make([]bool, len(patches))
+	perPath := make(map[string]int)
+	for changed := true; changed; {
+		changed = false
+		for i := len(patches) - 1; i >= 0; i-- {
+			p := patches[i]
+			path := normalizePath(p.Path)
+			hash, ok := current[path]
+			if kept[i] || !ok || perPath[path] >= maxPatchChain {
+				continue
+			}
+			if reachable[path] == nil {
+				reachable[path] = map[string]bool{hash: true}
+			}
+			if reachable[path][p.ToHash] && !reachable[path][p.FromHash] {
+				reachable[path][p.FromHash] = true
+				kept[i] = true
+				perPath[path]++
+				changed = true
+			}
+		}
+	}
+
+	var result []parsers.Patches
+	for i, p := range patches {
+		if kept[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// prunePublished removes published files that no patch can start from anymore
+func prunePublished(baseDir string, patches []parsers.Patches, resources []parsers.Resource) error {
+	keep := make(map[string]bool)
+	for _, r := range resources {
+		keep[r.Hash] = true
+	}
+	for _, p := range patches {
+		keep[p.FromHash] = true
+	}
+
+	entries, err := os.ReadDir(publishedDir(baseDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !keep[entry.Name()] {
+			if err := os.Remove(filepath.Join(publishedDir(baseDir), entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findPatchChain returns the patches that turn fromHash into toHash for path, or nil if there is no such chain
+func findPatchChain(patches []parsers.Patches, path, fromHash, toHash string) []parsers.Patches {
+	if fromHash == "" || toHash == "" || fromHash == toHash {
+		return nil
+	}
+
+	byFrom := make(map[string]parsers.Patches)
+	for _, p := range patches {
+		if normalizePath(p.Path) == path && p.URL != "" && p.FromHash != "" {
+			byFrom[p.FromHash] = p
+		}
+	}
+
+	var chain []parsers.Patches
+	hash := fromHash
+	for len(chain) < maxPatchChain {
+		p, ok := byFrom[hash]
+		if !ok {
+			return nil
+		}
+		chain = append(chain, p)
+		if p.ToHash == toHash {
+			return chain
+		}
+		hash = p.ToHash
+	}
+	return nil
+}
+
+// chainSize is the number of bytes needed to download every patch of chain
+func chainSize(chain []parsers.Patches) int64 {
+	var size int64
+	for _, p := range chain {
+		size += p.Size
+	}
+	return size
+}
+
+// downloadPatched rebuilds the new version of job.Resource from job.BasePath by applying job.Patches in order
+func downloadPatched(ctx context.Context, hosts *hostLimiter, job downloadJob, progressCb func(fileName string, downloadedBytes, totalBytes int64)) error {
+	filename := filepath.Base(job.Resource.Path)
+	total := chainSize(job.Patches)
+	utils.LogMessage(fmt.Sprintf("Patching %s with %d patch(es) (%s) ...", filename, len(job.Patches), utils.FormatSize(total)))
+
+	base := job.BasePath
+	var done int64
+	for i, p := range job.Patches {
+		patchPath := fmt.Sprintf("%s.patch%d", job.LocalPath, i)
+		err := hosts.fetch(ctx, p.URL, func() error {
+			return DownloadFile(ctx, p.URL, patchPath, filename+" (patch)", p.Size, p.Checksum(), func(fileName string, downloadedBytes, totalBytes int64) {
+				if progressCb != nil {
+					progressCb(fileName, done+downloadedBytes, total)
+				}
+			})
+		})
+		if err != nil {
+			return err
+		}
+		done += p.Size
+
+		// only the last patch has to produce a file of a known size
+		out, maxSize := job.LocalPath, job.Resource.Size
+		if i < len(job.Patches)-1 {
+			out, maxSize = fmt.Sprintf("%s.patched%d", job.LocalPath, i), maxDeltaInput
+		}
+		if maxSize <= 0 {
+			maxSize = maxDeltaInput
+		}
+		err = applyDelta(base, patchPath, out, maxSize)
+		_ = os.Remove(patchPath)
+		if base != job.BasePath {
+			_ = os.Remove(base)
+		}
+		if err != nil {
+			return err
+		}
+		base = out
+	}
+
+	if err := verifyChecksum(job.LocalPath, job.Resource.Checksum()); err != nil {
+		_ = os.Remove(job.LocalPath)
+		return fmt.Errorf("patched %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package workers
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// PlanAction is what the updater is going to do with a single path
+type PlanAction string
+
+const (
+	ActionAdd       PlanAction = "add"
+	ActionUpdate    PlanAction = "update"
+	ActionRemove    PlanAction = "remove"
+	ActionUnchanged PlanAction = "unchanged"
+)
+
+// PlanEntry is the planned action for one path. Resource is the remote resource and is nil for removals.
+type PlanEntry struct {
+	Path     string            `json:"path"`
+	Action   PlanAction        `json:"action"`
+	Resource *parsers.Resource `json:"resource,omitempty"`
+}
+
+// UpdatePlan is the difference between the remote manifest and what is actually on disk, keyed by path
+type UpdatePlan struct {
+	FromVersion string                `json:"from_version"`
+	ToVersion   string                `json:"to_version"`
+	Entries     map[string]*PlanEntry `json:"entries"`
+}
+
+// HasChanges reports whether applying the plan would touch any file
+func (p *UpdatePlan) HasChanges() bool {
+	for _, entry := range p.Entries {
+		if entry.Action != ActionUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// EntriesFor returns the entries with the given action, sorted by path
+func (p *UpdatePlan) EntriesFor(action PlanAction) []*PlanEntry {
+	var entries []*PlanEntry
+	for _, entry := range p.Entries {
+		if entry.Action == action {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// BuildUpdatePlan compares the remote manifest against the files in baseDir and the last applied manifest.
+// Files are always checked against the disk, index keeps that cheap for files that did not change since the last run.
+func BuildUpdatePlan(config *parsers.Config, remote, applied *parsers.ResourceSet, baseDir string, index *HashIndex) (*UpdatePlan, error) {
+	plan := &UpdatePlan{
+		ToVersion: remote.LocalVersion,
+		Entries:   make(map[string]*PlanEntry, len(remote.Resources)),
+	}
+	if applied != nil {
+		plan.FromVersion = applied.LocalVersion
+	}
+
+	for i := range remote.Resources {
+		r := &remote.Resources[i]
+		path := normalizePath(r.Path)
+		if _, exists := plan.Entries[path]; exists {
+			utils.LogWarning("Resource " + path + " is listed more than once, using the last entry.")
+		}
+		plan.Entries[path] = &PlanEntry{Path: path, Action: ActionUnchanged, Resource: r}
+	}
+
+	// Compare against what is actually on disk, not against what we think we installed
+	for _, r := range CheckResources(remote, baseDir, index) {
+		path := normalizePath(r.Path)
+		entry := plan.Entries[path]
+		if config.IsIgnored(path) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, path)); err != nil {
+			entry.Action = ActionAdd
+		} else if policyOf(config, r) != parsers.FolderPolicySeedOnce {
+			// seeded files are only created, the player owns them from then on
+			entry.Action = ActionUpdate
+		}
+	}
+
+	// Anything we installed last time that the remote set dropped, as long as the player did not change it
+	if applied != nil {
+		for _, r := range applied.Resources {
+			path := normalizePath(r.Path)
+			if _, exists := plan.Entries[path]; exists || !isSafeFolder(path) {
+				continue
+			}
+			if config.IsIgnored(path) || neverRemoved(policyOf(config, r)) {
+				continue
+			}
+			localPath := filepath.Join(baseDir, path)
+			if _, err := os.Stat(localPath); err != nil {
+				continue
+			}
+			if !localMatches(index, baseDir, r) {
+				utils.LogWarning("Keeping " + path + ", it was removed from the pack but has been modified locally.")
+				continue
+			}
+			plan.Entries[path] = &PlanEntry{Path: path, Action: ActionRemove}
+		}
+	}
+
+	stale, err := FindStaleFiles(config, remote, baseDir, index)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		if _, exists := plan.Entries[path]; !exists {
+			plan.Entries[path] = &PlanEntry{Path: path, Action: ActionRemove}
+		}
+	}
+
+	return plan, nil
+}
+
+// PlanFile is a file an update would download
+type PlanFile struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`              // bytes to transfer, the size of the patches when it is patched
+	Patched bool   `json:"patched,omitempty"` // rebuilt from the installed copy with delta patches
+}
+
+// PlanSummary is what an update would do, for showing to a player or a launcher before anything is touched
+type PlanSummary struct {
+	FromVersion     string     `json:"from_version"`
+	ToVersion       string     `json:"to_version"`
+	UpdateAvailable bool       `json:"update_available"`
+	Added           []PlanFile `json:"added"`
+	Updated         []PlanFile `json:"updated"`
+	Removed         []string   `json:"removed"`
+	MissingURL      []string   `json:"missing_url"` // files that would be skipped because the manifest has no URL for them
+	DownloadBytes   int64      `json:"download_bytes"`
+}
+
+// summarizePlan lists the files of plan with the number of bytes each of them would transfer
+func summarizePlan(plan *UpdatePlan, remoteSet *parsers.ResourceSet, baseDir string, index *HashIndex) *PlanSummary {
+	summary := &PlanSummary{
+		FromVersion: plan.FromVersion,
+		ToVersion:   plan.ToVersion,
+		Added:       []PlanFile{},
+		Updated:     []PlanFile{},
+		Removed:     []string{},
+		MissingURL:  []string{},
+	}
+
+	for _, entry := range append(plan.EntriesFor(ActionAdd), plan.EntriesFor(ActionUpdate)...) {
+		r := *entry.Resource
+		r.Path = entry.Path
+		if len(r.DownloadURLs()) == 0 {
+			utils.LogWarning("Unable to download " + entry.Path + ", download URL is empty.")
+			summary.MissingURL = append(summary.MissingURL, entry.Path)
+			continue
+		}
+
+		file := PlanFile{Path: entry.Path, Size: r.Size}
+		if entry.Action == ActionUpdate {
+			if chain := patchChainFor(remoteSet, baseDir, index, r); chain != nil {
+				file.Size = chainSize(chain)
+				file.Patched = true
+			}
+			summary.Updated = append(summary.Updated, file)
+		} else {
+			summary.Added = append(summary.Added, file)
+		}
+		summary.DownloadBytes += file.Size
+	}
+
+	for _, entry := range plan.EntriesFor(ActionRemove) {
+		summary.Removed = append(summary.Removed, entry.Path)
+	}
+
+	// files without a URL cannot be updated, they would keep an update pending forever
+	summary.UpdateAvailable = len(summary.Added) > 0 || len(summary.Updated) > 0 || len(summary.Removed) > 0
+	return summary
+}
@@ -0,0 +1,106 @@
+package workers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+)
+
+// shipped is a resource as the pack lists it, with the sha1 of content
+func shipped(path, content string) parsers.Resource {
+	return parsers.Resource{Path: path, Hash: sha1Checksum([]byte(content)).Value, URL: "https://example.com/" + path}
+}
+
+func TestBuildUpdatePlanFolderPolicies(t *testing.T) {
+	baseDir := t.TempDir()
+	disk := map[string]string{
+		"mods/a.jar":              "old a",
+		"mods/extra.jar":          "not in the pack",
+		"mods/local-map.jar":      "player's own mod",
+		"mods/local-tweaks.jar":   "player's build",
+		"resourcepacks/pack.zip":  "old pack",
+		"resourcepacks/mine.zip":  "player's pack",
+		"resourcepacks/old.zip":   "dropped pack",
+		"resourcepacks/gone.zip":  "tombstoned pack",
+		"config/options.toml":     "player's settings",
+		"config/dropped.toml":     "dropped defaults",
+		"shaderpacks/readme.txt":  "tombstoned readme",
+		"shaderpacks/old.zip":     "dropped shader",
+		"shaderpacks/notes.txt":   "dropped notes",
+		"shaderpacks/current.zip": "current shader",
+	}
+	for path, content := range disk {
+		writeTestFile(t, filepath.Join(baseDir, path), content)
+	}
+
+	config := &parsers.Config{Folders: []parsers.FolderSpec{
+		{Path: "mods", Policy: parsers.FolderPolicyMirror, Ignore: []string{"local-*.jar"}},
+		{Path: "resourcepacks", Policy: parsers.FolderPolicyAdditive},
+		{Path: "config", Policy: parsers.FolderPolicySeedOnce},
+		{Path: "shaderpacks", Ignore: []string{"*.txt"}},
+	}}
+	applied := &parsers.ResourceSet{LocalVersion: "1.0", Resources: []parsers.Resource{
+		shipped("mods/a.jar", "old a"),
+		shipped("resourcepacks/pack.zip", "old pack"),
+		shipped("resourcepacks/old.zip", "dropped pack"),
+		shipped("config/options.toml", "defaults"),
+		shipped("config/dropped.toml", "dropped defaults"),
+		shipped("shaderpacks/old.zip", "dropped shader"),
+		shipped("shaderpacks/notes.txt", "dropped notes"),
+		shipped("shaderpacks/current.zip", "current shader"),
+	}}
+	remote := &parsers.ResourceSet{
+		LocalVersion: "1.1",
+		Resources: []parsers.Resource{
+			shipped("mods/a.jar", "new a"),
+			shipped("mods/b.jar", "new b"),
+			shipped("mods/local-tweaks.jar", "the pack's build"),
+			shipped("resourcepacks/pack.zip", "new pack"),
+			shipped("config/options.toml", "new defaults"),
+			shipped("config/new.toml", "more defaults"),
+			shipped("shaderpacks/current.zip", "current shader"),
+		},
+		Removed: []parsers.Tombstone{
+			{Path: "resourcepacks/gone.zip", Hash: sha1Checksum([]byte("tombstoned pack")).Value},
+			{Path: "shaderpacks/readme.txt", Hash: sha1Checksum([]byte("tombstoned readme")).Value},
+		},
+	}
+
+	plan, err := BuildUpdatePlan(config, remote, applied, baseDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want PlanAction
+		why  string
+	}{
+		{"mods/a.jar", ActionUpdate, "mirror updates"},
+		{"mods/b.jar", ActionAdd, "mirror adds"},
+		{"mods/extra.jar", ActionRemove, "mirror removes files the pack does not list"},
+		{"mods/local-map.jar", ActionUnchanged, "ignored files are never removed"},
+		{"mods/local-tweaks.jar", ActionUnchanged, "ignored files are never overwritten"},
+		{"resourcepacks/pack.zip", ActionUpdate, "additive updates"},
+		{"resourcepacks/mine.zip", ActionUnchanged, "additive never removes files of the player"},
+		{"resourcepacks/old.zip", ActionUnchanged, "additive never removes files the pack dropped"},
+		{"resourcepacks/gone.zip", ActionUnchanged, "additive never removes tombstoned files"},
+		{"config/options.toml", ActionUnchanged, "seed-once never overwrites"},
+		{"config/new.toml", ActionAdd, "seed-once creates missing files"},
+		{"config/dropped.toml", ActionUnchanged, "seed-once never removes"},
+		{"shaderpacks/old.zip", ActionRemove, "sync removes files the pack dropped"},
+		{"shaderpacks/notes.txt", ActionUnchanged, "ignored files are never removed when the pack drops them"},
+		{"shaderpacks/readme.txt", ActionUnchanged, "ignored files are never removed by a tombstone"},
+		{"shaderpacks/current.zip", ActionUnchanged, "unchanged files stay"},
+	}
+	for _, tt := range tests {
+		got := ActionUnchanged
+		if entry, ok := plan.Entries[tt.path]; ok {
+			got = entry.Action
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s, want %s (%s)", tt.path, got, tt.want, tt.why)
+		}
+	}
+}
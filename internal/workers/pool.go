@@ -0,0 +1,226 @@
+package workers
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// downloadJob is a single file queued on the download pool. When Patches is set, the file
+// is rebuilt from BasePath with those patches first and only downloaded in full if that fails.
+type downloadJob struct {
+	Resource  parsers.Resource
+	LocalPath string
+	BasePath  string
+	Patches   []parsers.Patches
+}
+
+// expectedBytes is how much the job is expected to download
+func (j downloadJob) expectedBytes() int64 {
+	if len(j.Patches) > 0 {
+		return chainSize(j.Patches)
+	}
+	return j.Resource.Size
+}
+
+// fetch gets the job from the shared cache, or else downloads it, trying the patch chain before the full file.
+// Every verified download is added to the cache for the next instance that needs it.
+func (j downloadJob) fetch(ctx context.Context, policy retryPolicy, hosts *hostLimiter, cache *contentCache, progressCb func(fileName string, downloadedBytes, totalBytes int64)) error {
+	filename := filepath.Base(j.Resource.Path)
+	if cache.place(j.Resource, j.LocalPath) {
+		progressCb(filename, j.expectedBytes(), j.expectedBytes())
+		return nil
+	}
+
+	if len(j.Patches) > 0 {
+		err := downloadPatched(ctx, hosts, j, progressCb)
+		if err == nil {
+			cache.store(j.Resource.Checksum(), j.LocalPath)
+		}
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		utils.LogWarning("Patching " + filename + " failed, downloading the full file instead: " + err.Error())
+	}
+
+	err := downloadResource(ctx, policy, hosts, j.Resource, j.LocalPath, progressCb)
+	if err == nil {
+		cache.store(j.Resource.Checksum(), j.LocalPath)
+	}
+	return err
+}
+
+// hostLimiter caps how many connections are open to the same host at once
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+func (h *hostLimiter) slot(host string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.slots[host]
+	if !ok {
+		s = make(chan struct{}, h.limit)
+		h.slots[host] = s
+	}
+	return s
+}
+
+// acquire blocks until a connection to host is free or ctx is cancelled
+func (h *hostLimiter) acquire(ctx context.Context, host string) error {
+	select {
+	case h.slot(host) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *hostLimiter) release(host string) {
+	<-h.slot(host)
+}
+
+// fetch runs download while holding a connection slot for the host of rawURL. A nil limiter does not limit anything.
+func (h *hostLimiter) fetch(ctx context.Context, rawURL string, download func() error) error {
+	if h == nil {
+		return download()
+	}
+	host := hostOf(rawURL)
+	if err := h.acquire(ctx, host); err != nil {
+		return err
+	}
+	defer h.release(host)
+	return download()
+}
+
+// aggregateProgress merges the progress of every running download into a single stream,
+// so the GUI sees one total instead of several files fighting over the progress bar.
+type aggregateProgress struct {
+	mu         sync.Mutex
+	cb         func(fileName string, downloadedBytes, totalBytes int64, processed, total int)
+	perJob     []int64
+	downloaded int64
+	totalBytes int64
+	processed  int
+	total      int
+}
+
+func newAggregateProgress(jobs []downloadJob, cb func(fileName string, downloadedBytes, totalBytes int64, processed, total int)) *aggregateProgress {
+	p := &aggregateProgress{cb: cb, perJob: make([]int64, len(jobs)), total: len(jobs)}
+	for _, job := range jobs {
+		p.totalBytes += job.expectedBytes()
+	}
+	return p
+}
+
+// update records how many bytes job i has downloaded so far
+func (p *aggregateProgress) update(i int, fileName string, downloadedBytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloaded += downloadedBytes - p.perJob[i]
+	p.perJob[i] = downloadedBytes
+	p.cb(fileName, p.downloaded, p.totalBytes, p.processed, p.total)
+}
+
+// finish marks job i as done
+func (p *aggregateProgress) finish(i int, fileName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed++
+	p.cb(fileName, p.downloaded, p.totalBytes, p.processed, p.total)
+}
+
+// runDownloadPool downloads all jobs using at most config.MaxConcurrentDownloads workers.
+// The first failure cancels every other download, the failed job is returned along with its error.
+func runDownloadPool(ctx context.Context, config *parsers.Config, jobs []downloadJob, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int)) (*downloadJob, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workerCount := config.MaxConcurrentDownloads
+	if workerCount <= 0 {
+		workerCount = parsers.DefaultMaxConcurrentDownloads
+	}
+	if workerCount > len(jobs) {
+		workerCount = len(jobs)
+	}
+	perHost := config.MaxConnectionsPerHost
+	if perHost <= 0 {
+		perHost = parsers.DefaultMaxConnectionsPerHost
+	}
+
+	policy := newRetryPolicy(config)
+	cache := openContentCache(config)
+	hosts := newHostLimiter(perHost)
+	progress := newAggregateProgress(jobs, progressCb)
+	queue := make(chan int)
+
+	var (
+		wg        sync.WaitGroup
+		failOnce  sync.Once
+		failedJob *downloadJob
+		failErr   error
+	)
+	fail := func(i int, err error) {
+		failOnce.Do(func() {
+			failedJob = &jobs[i]
+			failErr = err
+			cancel()
+		})
+	}
+
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				job := jobs[i]
+				filename := filepath.Base(job.Resource.Path)
+				err := job.fetch(ctx, policy, hosts, cache, func(fileName string, downloadedBytes, totalBytes int64) {
+					progress.update(i, fileName, downloadedBytes)
+				})
+				if err != nil {
+					fail(i, err)
+					continue
+				}
+				progress.finish(i, filename)
+			}
+		}()
+	}
+
+feed:
+	for i := range jobs {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if cache != nil && failErr == nil {
+		if _, _, err := cache.gc(); err != nil {
+			utils.LogWarning("Failed to clean up the download cache: " + err.Error())
+		}
+	}
+	return failedJob, failErr
+}
+
+// hostOf returns the host part of rawURL, used to group connections per server
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
@@ -0,0 +1,108 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+)
+
+// testJobs returns one job per file name, downloading it from server into a temporary folder
+func testJobs(t *testing.T, server *httptest.Server, names ...string) []downloadJob {
+	t.Helper()
+	dir := t.TempDir()
+	jobs := make([]downloadJob, len(names))
+	for i, name := range names {
+		jobs[i] = downloadJob{
+			Resource:  parsers.Resource{Path: name, URL: server.URL + "/" + name},
+			LocalPath: filepath.Join(dir, name),
+		}
+	}
+	return jobs
+}
+
+func noProgress(string, int64, int64, int, int) {}
+
+func TestDownloadPoolLimitsConnectionsPerHost(t *testing.T) {
+	var running, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	var names []string
+	for i := 0; i < 12; i++ {
+		names = append(names, fmt.Sprintf("file%d.txt", i))
+	}
+	config := &parsers.Config{MaxConcurrentDownloads: 8, MaxConnectionsPerHost: 2}
+
+	failed, err := runDownloadPool(context.Background(), config, testJobs(t, server, names...), noProgress)
+	if err != nil {
+		t.Fatalf("%s failed: %v", failed.Resource.Path, err)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d connections to the same host at once, limit is 2", p)
+	}
+}
+
+func TestDownloadPoolFailureCancelsSiblings(t *testing.T) {
+	var (
+		started   sync.WaitGroup
+		cancelled atomic.Int32
+	)
+	started.Add(3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.txt" {
+			// only fail once every sibling is in the middle of its download
+			started.Wait()
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		started.Done()
+		select {
+		case <-r.Context().Done():
+			cancelled.Add(1)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	config := &parsers.Config{MaxConcurrentDownloads: 4, MaxConnectionsPerHost: 4}
+	jobs := testJobs(t, server, "slow1.txt", "slow2.txt", "slow3.txt", "missing.txt")
+
+	begin := time.Now()
+	failed, err := runDownloadPool(context.Background(), config, jobs, noProgress)
+	if err == nil {
+		t.Fatal("pool succeeded with a missing file")
+	}
+	if failed == nil || failed.Resource.Path != "missing.txt" {
+		t.Errorf("failed job is %+v, want missing.txt", failed)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("pool took %s, the other downloads were not cancelled", elapsed)
+	}
+
+	server.Close()
+	if n := cancelled.Load(); n != 3 {
+		t.Errorf("%d of 3 running downloads were cancelled", n)
+	}
+}
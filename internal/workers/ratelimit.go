@@ -0,0 +1,154 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	// minRateBurst keeps very low limits from stalling on a single read of the copy loop
+	minRateBurst = 16 * 1024
+	// maxRateSleep bounds every wait, so a limit changed from the GUI applies right away
+	maxRateSleep = 100 * time.Millisecond
+)
+
+// rateLimiter is a token bucket in bytes per second, a rate of 0 means unlimited.
+// Callers take what they read up front and wait until the bucket is out of debt.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	l := &rateLimiter{}
+	l.setRate(bytesPerSecond)
+	return l
+}
+
+func (l *rateLimiter) setRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = max(bytesPerSecond, 0)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// follow switches to bytesPerSecond when the rate changed since the last call
+func (l *rateLimiter) follow(bytesPerSecond int64) {
+	l.mu.Lock()
+	changed := l.rate != max(bytesPerSecond, 0)
+	l.mu.Unlock()
+	if changed {
+		l.setRate(bytesPerSecond)
+	}
+}
+
+func (l *rateLimiter) burst() float64 {
+	return float64(max(l.rate/10, minRateBurst))
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), l.burst())
+	l.last = now
+}
+
+// wait blocks until n bytes fit into the limit or ctx is cancelled
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.rate > 0 {
+		l.refill()
+		l.tokens -= float64(n)
+	}
+	l.mu.Unlock()
+
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill()
+		if l.tokens >= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		sleep := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(min(sleep, maxRateSleep)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+var (
+	// downloadLimiter is shared by every download, so the limit holds across concurrent connections
+	downloadLimiter = newRateLimiter(0)
+	// connectionRate is the limit for a single download, every download follows it while it runs
+	connectionRate atomic.Int64
+)
+
+// SetDownloadRateLimit limits all downloads together to bytesPerSecond, 0 removes the limit.
+// It is safe to call while downloads are running.
+func SetDownloadRateLimit(bytesPerSecond int64) {
+	downloadLimiter.setRate(bytesPerSecond)
+}
+
+// SetConnectionRateLimit limits every single download to bytesPerSecond, 0 removes the limit.
+// It is safe to call while downloads are running.
+func SetConnectionRateLimit(bytesPerSecond int64) {
+	connectionRate.Store(max(bytesPerSecond, 0))
+}
+
+// connectionLimiter limits a single download to the per connection rate
+type connectionLimiter struct {
+	limiter *rateLimiter
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{limiter: newRateLimiter(connectionRate.Load())}
+}
+
+// wait blocks until n bytes fit into the current per connection limit or ctx is cancelled
+func (c *connectionLimiter) wait(ctx context.Context, n int) error {
+	c.limiter.follow(connectionRate.Load())
+	return c.limiter.wait(ctx, n)
+}
+
+// ApplyRateLimits sets the bandwidth limits of the config. It is called once at startup,
+// so a limit the player picks in the window later on is not overwritten by the next update.
+func ApplyRateLimits(config *parsers.Config) error {
+	globalRate, err := utils.ParseSize(config.DownloadRateLimit)
+	if err != nil {
+		return fmt.Errorf("download_rate_limit: %v", err)
+	}
+	connRate, err := utils.ParseSize(config.ConnectionRateLimit)
+	if err != nil {
+		return fmt.Errorf("connection_rate_limit: %v", err)
+	}
+
+	SetDownloadRateLimit(globalRate)
+	SetConnectionRateLimit(connRate)
+	if globalRate > 0 {
+		utils.LogMessage("Download speed limited to " + utils.FormatSize(globalRate) + "/s")
+	}
+	if connRate > 0 {
+		utils.LogMessage("Speed per download limited to " + utils.FormatSize(connRate) + "/s")
+	}
+	return nil
+}
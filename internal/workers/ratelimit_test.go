@@ -0,0 +1,29 @@
+package workers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiterFollowsChanges(t *testing.T) {
+	defer SetConnectionRateLimit(0)
+	SetConnectionRateLimit(0)
+	limiter := newConnectionLimiter()
+	if err := limiter.wait(context.Background(), 1<<20); err != nil {
+		t.Fatalf("unlimited download waited: %v", err)
+	}
+
+	// a limit picked while the download is running applies to its next chunk
+	SetConnectionRateLimit(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx, 1<<20); err == nil {
+		t.Error("a megabyte went through a 1KB/s limit right away")
+	}
+
+	SetConnectionRateLimit(0)
+	if err := limiter.wait(context.Background(), 1<<20); err != nil {
+		t.Errorf("removing the limit did not apply: %v", err)
+	}
+}
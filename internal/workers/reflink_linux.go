@@ -0,0 +1,34 @@
+//go:build linux
+
+package workers
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, supported by btrfs, xfs and a few other file systems
+const ficlone = 0x40049409
+
+// reflinkFile creates dst as a copy-on-write clone of src
+func reflinkFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if closeErr := out.Close(); errno == 0 && closeErr != nil {
+		return closeErr
+	}
+	if errno != 0 {
+		_ = os.Remove(dst)
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package workers
+
+import "errors"
+
+// reflinkFile is not available here, the cache falls back to copies
+func reflinkFile(src, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -1,8 +1,6 @@
 package workers
 
 import (
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 
@@ -10,8 +8,9 @@ import (
 	"github.com/cosmiclabstudio/cargodrop/internal/utils"
 )
 
-// CheckResources compares local files to expected hashes and returns resources needing update
-func CheckResources(rs *parsers.ResourceSet, baseDir string) []parsers.Resource {
+// CheckResources compares local files to expected hashes and returns resources needing update.
+// Files that did not change since they were last hashed are looked up in index instead, pass nil to hash everything.
+func CheckResources(rs *parsers.ResourceSet, baseDir string, index *HashIndex) []parsers.Resource {
 	var toUpdate []parsers.Resource
 	for _, r := range rs.Resources {
 		localPath := filepath.Join(baseDir, r.Path)
@@ -23,9 +22,8 @@ func CheckResources(rs *parsers.ResourceSet, baseDir string) []parsers.Resource
 			continue
 		}
 
-		// File exists, compare SHA1 hash
-		localHash, err := utils.GenerateSHA1(localPath)
-		if err != nil || localHash != r.Hash {
+		// File exists, compare its hash
+		if !localMatches(index, baseDir, r) {
 			// Hash mismatch or error reading file, needs update
 			toUpdate = append(toUpdate, r)
 		}
@@ -34,65 +32,28 @@ func CheckResources(rs *parsers.ResourceSet, baseDir string) []parsers.Resource
 	return toUpdate
 }
 
-// DownloadFile downloads a file and reports progress
-func DownloadFile(url, localPath, fileName string, expectedSize int64, progressCb func(fileName string, downloadedBytes, totalBytes int64)) error {
-	utils.LogMessage("Downloading " + fileName + " (" + utils.FormatSize(expectedSize) + ") ...")
-	resp, err := http.Get(url)
-	if err != nil {
-		utils.LogError(err)
-		return err
+// localMatches reports whether the file of r in baseDir is the one the manifest lists, compared with the
+// strongest hash r has. The hash index is trusted for files that did not change since they were last hashed by us.
+func localMatches(index *HashIndex, baseDir string, r parsers.Resource) bool {
+	checksum := r.Checksum()
+	if checksum.IsZero() {
+		return false
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			utils.LogError(err)
-		}
-	}()
+	localHash, err := hashFile(index, baseDir, r.Path, checksum.Algorithm)
+	return err == nil && localHash == checksum.Value
+}
 
-	if resp.StatusCode != http.StatusOK {
-		utils.LogWarning("Download failed " + url + ": " + resp.Status)
-		return err
+// verifyChecksum hashes the file at path with the algorithm of expected and returns a *hashMismatchError when it differs
+func verifyChecksum(path string, expected parsers.Checksum) error {
+	if expected.IsZero() {
+		return nil
 	}
-
-	dir := filepath.Dir(localPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		utils.LogError(err)
-		return err
-	}
-
-	out, err := os.Create(localPath)
+	sums, err := utils.HashFile(path, expected.Algorithm)
 	if err != nil {
-		utils.LogError(err)
 		return err
 	}
-	defer func() {
-		if err := out.Close(); err != nil {
-			utils.LogError(err)
-		}
-	}()
-
-	totalBytes := expectedSize
-	var downloadedBytes int64
-	buf := make([]byte, 32*1024)
-	for {
-		n, readErr := resp.Body.Read(buf)
-		if n > 0 {
-			wn, writeErr := out.Write(buf[:n])
-			if writeErr != nil {
-				utils.LogError(writeErr)
-				return writeErr
-			}
-			downloadedBytes += int64(wn)
-			if progressCb != nil {
-				progressCb(fileName, downloadedBytes, totalBytes)
-			}
-		}
-		if readErr != nil {
-			if readErr != io.EOF {
-				utils.LogError(readErr)
-				return readErr
-			}
-			break
-		}
+	if actual := sums[expected.Algorithm]; actual != expected.Value {
+		return &hashMismatchError{File: filepath.Base(path), Algorithm: expected.Algorithm, Expected: expected.Value, Actual: actual}
 	}
 	return nil
 }
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package workers
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartExecutable replaces this process with exe, started with the same arguments and env.
+// It only returns when that failed.
+func restartExecutable(exe string, env []string) error {
+	return syscall.Exec(exe, append([]string{exe}, os.Args[1:]...), env)
+}
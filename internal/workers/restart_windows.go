@@ -0,0 +1,28 @@
+//go:build windows
+
+package workers
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// restartExecutable runs exe with the same arguments and env and exits with its exit code once it is done,
+// Windows cannot replace a running process. It only returns when exe could not be started.
+func restartExecutable(exe string, env []string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	os.Exit(0)
+	return nil
+}
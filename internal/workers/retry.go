@@ -0,0 +1,200 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// maxRetryAfter caps how long we are willing to wait when a server asks us to come back later
+const maxRetryAfter = 5 * time.Minute
+
+// httpStatusError is returned when the server answers with anything we cannot download from
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("download of %s failed: %s", e.URL, e.Status)
+}
+
+func newHTTPStatusError(url string, resp *http.Response) *httpStatusError {
+	return &httpStatusError{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// hashMismatchError is returned when a downloaded file is not what the manifest says it should be
+type hashMismatchError struct {
+	File      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *hashMismatchError) Error() string {
+	return fmt.Sprintf("%s has %s hash %s, expected %s", e.File, e.Algorithm, e.Actual, e.Expected)
+}
+
+// sizeMismatchError is returned when a download is longer or shorter than the manifest says it should be
+type sizeMismatchError struct {
+	File     string
+	Expected int64
+	Actual   int64
+}
+
+func (e *sizeMismatchError) Error() string {
+	return fmt.Sprintf("%s has %d bytes, expected %d", e.File, e.Actual, e.Expected)
+}
+
+// parseRetryAfter understands both forms of Retry-After, delay seconds and an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// isRetryable sorts errors into ones worth another attempt (server hiccups, rate limits, network
+// trouble, a corrupted transfer) and permanent ones (missing files, forbidden, local disk errors).
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusRequestTimeout
+	}
+
+	// a corrupted or truncated transfer, or a CDN edge serving the wrong file
+	var hashErr *hashMismatchError
+	var sizeErr *sizeMismatchError
+	if errors.As(err, &hashErr) || errors.As(err, &sizeErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// anything failing on our side of the disk will fail again
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return false
+	}
+	return true
+}
+
+// retryPolicy retries retryable errors with exponential backoff and jitter
+type retryPolicy struct {
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	// jitter returns a random duration up to n, and sleep waits for d unless ctx is cancelled first
+	jitter func(n time.Duration) time.Duration
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryPolicy(config *parsers.Config) retryPolicy {
+	policy := retryPolicy{
+		maxAttempts:  config.Retry.MaxAttempts,
+		initialDelay: time.Duration(config.Retry.InitialDelayMs) * time.Millisecond,
+		maxDelay:     time.Duration(config.Retry.MaxDelayMs) * time.Millisecond,
+		jitter:       rand.N[time.Duration],
+		sleep:        sleepContext,
+	}
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = parsers.DefaultRetryAttempts
+	}
+	if policy.initialDelay <= 0 {
+		policy.initialDelay = parsers.DefaultRetryInitialDelayMs * time.Millisecond
+	}
+	if policy.maxDelay <= 0 {
+		policy.maxDelay = parsers.DefaultRetryMaxDelayMs * time.Millisecond
+	}
+	return policy
+}
+
+// delay returns how long to wait before the given retry (1 for the first retry)
+func (p retryPolicy) delay(retry int, err error) time.Duration {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return min(statusErr.RetryAfter, maxRetryAfter)
+	}
+
+	d := p.initialDelay
+	for i := 1; i < retry && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxDelay)
+
+	// jitter between half and the full delay, so parallel downloads do not retry in lockstep
+	return d/2 + p.jitter(d/2+1)
+}
+
+// do runs fn until it succeeds, fails with a permanent error, or runs out of attempts
+func (p retryPolicy) do(ctx context.Context, what string, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= p.maxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isRetryable(err) {
+			utils.LogWarning(fmt.Sprintf("%s failed permanently: %v", what, err))
+			return err
+		}
+		if attempt == p.maxAttempts {
+			break
+		}
+
+		wait := p.delay(attempt, err)
+		utils.LogWarning(fmt.Sprintf("%s failed (attempt %d/%d): %v, retrying in %s", what, attempt, p.maxAttempts, err, wait.Round(100*time.Millisecond)))
+		if err := p.sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%s failed after %d attempts: %v", what, p.maxAttempts, err)
+}
+
+// sleepContext waits for d, or returns the error of ctx when it is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
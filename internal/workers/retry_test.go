@@ -0,0 +1,111 @@
+package workers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy is a policy without jitter that records its waits instead of sleeping
+func testRetryPolicy(waits *[]time.Duration) retryPolicy {
+	return retryPolicy{
+		maxAttempts:  5,
+		initialDelay: 100 * time.Millisecond,
+		maxDelay:     300 * time.Millisecond,
+		jitter:       func(time.Duration) time.Duration { return 0 },
+		sleep: func(ctx context.Context, d time.Duration) error {
+			*waits = append(*waits, d)
+			return nil
+		},
+	}
+}
+
+func statusError(code int, retryAfter time.Duration) error {
+	return &httpStatusError{URL: "https://example.com/a.jar", StatusCode: code, Status: http.StatusText(code), RetryAfter: retryAfter}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ms := time.Millisecond
+	backoff := []time.Duration{50 * ms, 100 * ms, 150 * ms, 150 * ms}
+
+	tests := []struct {
+		name     string
+		errs     []error // what every attempt returns, the last one repeats
+		attempts int
+		waits    []time.Duration
+		success  bool
+	}{
+		{name: "server error", errs: []error{statusError(500, 0)}, attempts: 5, waits: backoff},
+		{name: "server error then success", errs: []error{statusError(503, 0), nil}, attempts: 2, waits: backoff[:1], success: true},
+		{name: "request timeout", errs: []error{statusError(408, 0)}, attempts: 5, waits: backoff},
+		{name: "rate limited", errs: []error{statusError(429, 3*time.Second), nil}, attempts: 2, waits: []time.Duration{3 * time.Second}, success: true},
+		{name: "rate limited for too long", errs: []error{statusError(429, time.Hour), nil}, attempts: 2, waits: []time.Duration{maxRetryAfter}, success: true},
+		{name: "not found", errs: []error{statusError(404, 0)}, attempts: 1},
+		{name: "forbidden", errs: []error{statusError(403, 0)}, attempts: 1},
+		{name: "hash mismatch", errs: []error{&hashMismatchError{File: "a.jar"}, nil}, attempts: 2, waits: backoff[:1], success: true},
+		{name: "size mismatch", errs: []error{&sizeMismatchError{File: "a.jar"}}, attempts: 5, waits: backoff},
+		{name: "cut off", errs: []error{io.ErrUnexpectedEOF, nil}, attempts: 2, waits: backoff[:1], success: true},
+		{name: "disk error", errs: []error{&os.PathError{Op: "write", Path: "a.jar", Err: os.ErrPermission}}, attempts: 1},
+		{name: "cancelled", errs: []error{context.Canceled}, attempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var waits []time.Duration
+			attempts := 0
+			err := testRetryPolicy(&waits).do(context.Background(), "Download", func() error {
+				err := tt.errs[min(attempts, len(tt.errs)-1)]
+				attempts++
+				return err
+			})
+
+			if (err == nil) != tt.success {
+				t.Errorf("got error %v, want success %v", err, tt.success)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			if !reflect.DeepEqual(waits, tt.waits) {
+				t.Errorf("waited %v, want %v", waits, tt.waits)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var waits []time.Duration
+	attempts := 0
+	err := testRetryPolicy(&waits).do(ctx, "Download", func() error {
+		attempts++
+		cancel()
+		return statusError(500, 0)
+	})
+	if err != context.Canceled || attempts != 1 || len(waits) != 0 {
+		t.Errorf("got %v after %d attempts and %d waits, want a single cancelled attempt", err, attempts, len(waits))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	inAMinute := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{value: "", min: 0, max: 0},
+		{value: "120", min: 2 * time.Minute, max: 2 * time.Minute},
+		{value: "-5", min: 0, max: 0},
+		{value: "soon", min: 0, max: 0},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", min: 0, max: 0},
+		{value: inAMinute, min: 55 * time.Second, max: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
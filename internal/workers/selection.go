@@ -0,0 +1,143 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// GroupSelection is which optional groups the player picked, kept in .cargodrop/selection.json.
+// Groups the player never decided on fall back to their default.
+type GroupSelection struct {
+	baseDir string
+	Groups  map[string]bool `json:"groups"`
+}
+
+func selectionPath(baseDir string) string {
+	return filepath.Join(stateDir(baseDir), "selection.json")
+}
+
+// LoadGroupSelection reads the selection of baseDir, a missing or corrupt file means nothing was decided yet
+func LoadGroupSelection(baseDir string) *GroupSelection {
+	selection := &GroupSelection{baseDir: baseDir, Groups: make(map[string]bool)}
+	data, err := os.ReadFile(selectionPath(baseDir))
+	if err != nil {
+		return selection
+	}
+	if err := json.Unmarshal(data, selection); err != nil || selection.Groups == nil {
+		utils.LogWarning("Optional content selection is corrupt, using the defaults.")
+		selection.Groups = make(map[string]bool)
+	}
+	return selection
+}
+
+// IsSelected reports whether group is going to be installed
+func (s *GroupSelection) IsSelected(group parsers.Group) bool {
+	if selected, decided := s.Groups[group.Name]; decided {
+		return selected
+	}
+	return group.Default
+}
+
+// Selected returns the selection for every group in groups, defaults included
+func (s *GroupSelection) Selected(groups []parsers.Group) map[string]bool {
+	selected := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		selected[group.Name] = s.IsSelected(group)
+	}
+	return selected
+}
+
+// Undecided returns the groups the player has not been asked about yet
+func (s *GroupSelection) Undecided(groups []parsers.Group) []parsers.Group {
+	var undecided []parsers.Group
+	for _, group := range groups {
+		if _, decided := s.Groups[group.Name]; !decided {
+			undecided = append(undecided, group)
+		}
+	}
+	return undecided
+}
+
+// Set records the player's choice for the group called name
+func (s *GroupSelection) Set(name string, selected bool) {
+	s.Groups[name] = selected
+}
+
+// Save writes the selection to baseDir
+func (s *GroupSelection) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(selectionPath(s.baseDir), data)
+}
+
+// chooseGroups updates selection from the command line, or asks the player about groups they have not seen yet
+// (about every group when they asked to change their choice)
+func chooseGroups(groups []parsers.Group, selection *GroupSelection, opts UpdateOptions) {
+	switch {
+	case opts.Groups != nil:
+		wanted := make(map[string]bool, len(opts.Groups))
+		for _, name := range opts.Groups {
+			wanted[name] = true
+		}
+		for _, group := range groups {
+			selection.Set(group.Name, wanted[group.Name])
+			delete(wanted, group.Name)
+		}
+		for name := range wanted {
+			utils.LogWarning("The pack has no optional group called " + name + ".")
+		}
+	case opts.ChooseGroups != nil && (opts.ChangeGroups || len(selection.Undecided(groups)) > 0):
+		for name, selected := range opts.ChooseGroups(groups, selection.Selected(groups)) {
+			selection.Set(name, selected)
+		}
+	}
+
+	var names []string
+	for _, group := range groups {
+		if selection.IsSelected(group) {
+			names = append(names, group.Name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		utils.LogMessage("Optional content: none")
+	} else {
+		utils.LogMessage("Optional content: " + strings.Join(names, ", "))
+	}
+}
+
+// selectResources returns rs without the resources meant for the other side and without the groups the player
+// did not pick. The set hash of rs does not describe the filtered set, so it is left out.
+func selectResources(rs *parsers.ResourceSet, selection *GroupSelection, side string) *parsers.ResourceSet {
+	selected := selection.Selected(rs.Groups)
+	filtered := *rs
+	filtered.Resources = make([]parsers.Resource, 0, len(rs.Resources))
+	otherSide := 0
+	for _, r := range rs.Resources {
+		if !r.IsFor(side) {
+			otherSide++
+			continue
+		}
+		// a group the pack never declared cannot be picked, so it is not optional either
+		if picked, declared := selected[r.Group]; r.Group == "" || !declared || picked {
+			filtered.Resources = append(filtered.Resources, r)
+		}
+	}
+	if otherSide > 0 {
+		utils.LogMessage(fmt.Sprintf("Skipping %d files that are not needed on the %s side.", otherSide, side))
+	}
+	if len(filtered.Resources) == len(rs.Resources) {
+		return rs
+	}
+	filtered.ResourceSetHash = ""
+	return &filtered
+}
@@ -0,0 +1,44 @@
+package workers
+
+import (
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+)
+
+func TestChooseGroupsAsksAgainWhenChanging(t *testing.T) {
+	groups := []parsers.Group{{Name: "shaders"}, {Name: "minimap", Default: true}}
+
+	tests := []struct {
+		name    string
+		decided map[string]bool
+		change  bool
+		asked   bool
+	}{
+		{name: "first run", decided: map[string]bool{}, asked: true},
+		{name: "everything decided", decided: map[string]bool{"shaders": true, "minimap": true}},
+		{name: "changing a decided choice", decided: map[string]bool{"shaders": true, "minimap": true}, change: true, asked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection := &GroupSelection{baseDir: t.TempDir(), Groups: tt.decided}
+			asked := false
+			opts := UpdateOptions{ChangeGroups: tt.change, ChooseGroups: func(offered []parsers.Group, selected map[string]bool) map[string]bool {
+				asked = true
+				if len(offered) != len(groups) {
+					t.Errorf("offered %d groups, want all %d", len(offered), len(groups))
+				}
+				return map[string]bool{"shaders": false, "minimap": true}
+			}}
+
+			chooseGroups(groups, selection, opts)
+			if asked != tt.asked {
+				t.Fatalf("asked %v, want %v", asked, tt.asked)
+			}
+			if asked && selection.IsSelected(groups[0]) {
+				t.Error("the new choice was not kept")
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+const (
+	// SelfTestArg makes cargodrop print its version and exit, a new build has to pass it before it replaces the running one
+	SelfTestArg = "--self-test"
+	// selfUpdatedEnv tells the restarted updater which version it was updated to, so it does not try again
+	selfUpdatedEnv  = "CARGODROP_SELF_UPDATED"
+	selfTestTimeout = 30 * time.Second
+	// Files kept next to the executable by a self-update: the previous build, a marker holding the new version until
+	// that build started and read its config and manifest, the version that had to be rolled back so it is not
+	// installed again, and a rolled back build that was still running when it was moved aside.
+	oldBuildSuffix     = ".old"
+	pendingBuildSuffix = ".pending"
+	failedBuildSuffix  = ".failed"
+	brokenBuildSuffix  = ".broken"
+)
+
+// currentExecutable returns the path of the running executable with symlinks resolved
+func currentExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// RecoverSelfUpdate puts the previous build back when the build a self-update installed never confirmed that it works,
+// and restarts the restored build in place of this one. It is called before anything else, and also cleans up
+// the builds earlier self-updates left behind.
+func RecoverSelfUpdate() {
+	if os.Getenv(selfUpdatedEnv) != "" {
+		// the new build on its first run, on Windows the previous build is still running and waiting for it
+		return
+	}
+	exe, err := currentExecutable()
+	if err != nil {
+		return
+	}
+	if !recoverExecutable(exe) {
+		return
+	}
+	err = restartExecutable(exe, os.Environ())
+	// only returns when the restored build could not be started, this build goes on
+	utils.LogError(fmt.Errorf("failed to restart CargoDrop: %v", err))
+}
+
+// recoverExecutable rolls exe back to the previous build when the one a self-update installed was never confirmed,
+// or else removes the builds that are no longer needed. It reports whether exe was rolled back.
+func recoverExecutable(exe string) bool {
+	if version, err := os.ReadFile(exe + pendingBuildSuffix); err == nil {
+		failed := strings.TrimSpace(string(version))
+		utils.LogWarning("CargoDrop " + failed + " did not start properly last time, restoring the previous build...")
+		err := rollbackExecutable(exe)
+		if err == nil {
+			if err := os.WriteFile(exe+failedBuildSuffix, []byte(failed), 0644); err != nil {
+				utils.LogError(err)
+			}
+			return true
+		}
+		utils.LogError(fmt.Errorf("failed to restore the previous CargoDrop: %v", err))
+		_ = os.Remove(exe + pendingBuildSuffix)
+	}
+
+	// a build that is still running (Windows keeps the previous one running until the new one exits)
+	// cannot be removed yet, it is tried again on the next start
+	for _, suffix := range []string{oldBuildSuffix, brokenBuildSuffix} {
+		_ = os.Remove(exe + suffix)
+	}
+	return false
+}
+
+// ConfirmSelfUpdate is called once the build a self-update installed has started and read its config and manifest.
+// From then on it is trusted, the previous build is removed on the next start.
+func ConfirmSelfUpdate() {
+	if os.Getenv(selfUpdatedEnv) == "" {
+		return
+	}
+	exe, err := currentExecutable()
+	if err != nil {
+		return
+	}
+	confirmExecutable(exe)
+}
+
+// confirmExecutable trusts the build at exe. The previous build may still be running, so only the markers go now.
+func confirmExecutable(exe string) {
+	for _, suffix := range []string{pendingBuildSuffix, failedBuildSuffix} {
+		if err := os.Remove(exe + suffix); err != nil && !os.IsNotExist(err) {
+			utils.LogError(err)
+		}
+	}
+}
+
+// failedBefore reports whether version is the one that had to be rolled back last time.
+// The record is dropped once a newer release is out, that one gets its chance.
+func failedBefore(exe, version string) bool {
+	data, err := os.ReadFile(exe + failedBuildSuffix)
+	if err != nil {
+		return false
+	}
+	failed := strings.TrimSpace(string(data))
+	if failed == version {
+		return true
+	}
+	if utils.CompareVersions(version, failed) > 0 {
+		_ = os.Remove(exe + failedBuildSuffix)
+	}
+	return false
+}
+
+// selfUpdate replaces the running executable with the release the pack asks for and restarts it with the same arguments.
+// It only returns when there is nothing to update or the self-update failed, the pack update then goes on with this build.
+func selfUpdate(config *parsers.Config, release *parsers.Release, opts UpdateOptions) {
+	if updated := os.Getenv(selfUpdatedEnv); updated != "" {
+		utils.LogMessage("CargoDrop was updated to " + updated + ".")
+		return
+	}
+	if release == nil || utils.CompareVersions(release.Version, utils.Version) <= 0 {
+		return
+	}
+
+	exe, err := currentExecutable()
+	if err != nil {
+		utils.LogWarning("Unable to find the CargoDrop executable, skipping the self-update: " + err.Error())
+		return
+	}
+	if failedBefore(exe, release.Version) {
+		utils.LogWarning("CargoDrop " + release.Version + " did not work last time, staying on " + utils.Version + ".")
+		return
+	}
+	build, ok := release.BuildFor(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		utils.LogWarning(fmt.Sprintf("CargoDrop %s is available, but not for %s/%s.", release.Version, runtime.GOOS, runtime.GOARCH))
+		return
+	}
+	if build.URL == "" || build.Checksum().IsZero() {
+		utils.LogWarning("CargoDrop " + release.Version + " is available, but the pack does not say where to get it or its hash.")
+		return
+	}
+
+	utils.LogMessage("Updating CargoDrop from " + utils.Version + " to " + release.Version + "...")
+	if err := replaceExecutable(config, exe, build, release.Version); err != nil {
+		utils.LogError(fmt.Errorf("self-update failed: %v", err))
+		utils.LogWarning("Continuing with CargoDrop " + utils.Version + ".")
+		return
+	}
+
+	utils.LogMessage("Restarting CargoDrop " + release.Version + "...")
+	if opts.BeforeRestart != nil {
+		opts.BeforeRestart()
+	}
+	err = restartExecutable(exe, append(os.Environ(), selfUpdatedEnv+"="+release.Version))
+	// only returns when the new build could not be started at all
+	utils.LogError(fmt.Errorf("failed to restart CargoDrop: %v", err))
+	if err := rollbackExecutable(exe); err != nil {
+		utils.LogError(fmt.Errorf("failed to restore the previous CargoDrop: %v", err))
+	} else {
+		utils.LogWarning("Restored CargoDrop " + utils.Version + ".")
+	}
+}
+
+// replaceExecutable downloads build next to exe, makes sure it starts and swaps it in. The running build is kept as exe.old
+// and exe.pending marks the new build as not confirmed yet, until then the next start rolls it back.
+func replaceExecutable(config *parsers.Config, exe string, build parsers.ReleaseBuild, version string) error {
+	newPath := exe + ".new"
+	ctx := context.Background()
+	err := newRetryPolicy(config).do(ctx, "Download of CargoDrop "+version, func() error {
+		return DownloadFile(ctx, build.URL, newPath, filepath.Base(exe), build.Size, build.Checksum(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(newPath, 0755); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+
+	if err := selfTest(newPath, version); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+
+	if err := os.WriteFile(exe+pendingBuildSuffix, []byte(version), 0644); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+
+	// a running executable can be renamed everywhere, even where it cannot be replaced or deleted
+	oldPath := exe + oldBuildSuffix
+	_ = os.Remove(oldPath)
+	if err := os.Rename(exe, oldPath); err != nil {
+		_ = os.Remove(newPath)
+		_ = os.Remove(exe + pendingBuildSuffix)
+		return err
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		_ = os.Rename(oldPath, exe)
+		_ = os.Remove(newPath)
+		_ = os.Remove(exe + pendingBuildSuffix)
+		return err
+	}
+	return nil
+}
+
+// selfTest starts the executable at path with SelfTestArg and checks that it is the version we asked for
+func selfTest(path, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, SelfTestArg).Output()
+	if err != nil {
+		return fmt.Errorf("new build does not start: %v", err)
+	}
+	if reported := strings.TrimSpace(string(out)); reported != version {
+		return fmt.Errorf("new build reports version %q instead of %q", reported, version)
+	}
+	return nil
+}
+
+// rollbackExecutable puts the build kept by replaceExecutable back in place of exe. The build at exe may be
+// the running one, which Windows does not let us delete, so it is moved aside and removed on the next start.
+func rollbackExecutable(exe string) error {
+	oldPath := exe + oldBuildSuffix
+	if _, err := os.Stat(oldPath); err != nil {
+		return errors.New("the previous build is gone")
+	}
+	brokenPath := exe + brokenBuildSuffix
+	_ = os.Remove(brokenPath)
+	if err := os.Rename(exe, brokenPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(oldPath, exe); err != nil {
+		_ = os.Rename(brokenPath, exe)
+		return err
+	}
+	if err := os.Remove(exe + pendingBuildSuffix); err != nil && !os.IsNotExist(err) {
+		utils.LogError(err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package workers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// selfUpdated sets up dir like replaceExecutable leaves it: version 2.0 installed as the executable,
+// the previous build next to it and the new build not confirmed yet
+func selfUpdated(t *testing.T) string {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "cargodrop")
+	writeTestFile(t, exe, "build 2.0")
+	writeTestFile(t, exe+oldBuildSuffix, "build 1.0")
+	writeTestFile(t, exe+pendingBuildSuffix, "2.0")
+	return exe
+}
+
+// assertSelfUpdateFiles checks the executable and everything a self-update keeps next to it, anything not in want must not exist
+func assertSelfUpdateFiles(t *testing.T, exe string, want map[string]string) {
+	t.Helper()
+	files := map[string]string{
+		"cargodrop":                      "",
+		"cargodrop" + oldBuildSuffix:     "",
+		"cargodrop" + pendingBuildSuffix: "",
+		"cargodrop" + failedBuildSuffix:  "",
+		"cargodrop" + brokenBuildSuffix:  "",
+	}
+	for name, content := range want {
+		files[name] = content
+	}
+	assertTree(t, filepath.Dir(exe), files)
+}
+
+func TestRecoverUnconfirmedSelfUpdate(t *testing.T) {
+	exe := selfUpdated(t)
+
+	if !recoverExecutable(exe) {
+		t.Fatal("unconfirmed build was not rolled back")
+	}
+	// the new build may be the one running, so it is only moved aside
+	assertSelfUpdateFiles(t, exe, map[string]string{
+		"cargodrop":                     "build 1.0",
+		"cargodrop" + failedBuildSuffix: "2.0",
+		"cargodrop" + brokenBuildSuffix: "build 2.0",
+	})
+	if !failedBefore(exe, "2.0") {
+		t.Error("rolled back version would be installed again")
+	}
+
+	// the next start of the restored build cleans up
+	if recoverExecutable(exe) {
+		t.Fatal("restored build was rolled back again")
+	}
+	assertSelfUpdateFiles(t, exe, map[string]string{
+		"cargodrop":                     "build 1.0",
+		"cargodrop" + failedBuildSuffix: "2.0",
+	})
+}
+
+func TestConfirmedSelfUpdateKeepsTheNewBuild(t *testing.T) {
+	exe := selfUpdated(t)
+	writeTestFile(t, exe+failedBuildSuffix, "1.5")
+
+	confirmExecutable(exe)
+	// the previous build may still be running right now, it stays until the next start
+	assertSelfUpdateFiles(t, exe, map[string]string{
+		"cargodrop":                  "build 2.0",
+		"cargodrop" + oldBuildSuffix: "build 1.0",
+	})
+
+	if recoverExecutable(exe) {
+		t.Fatal("confirmed build was rolled back")
+	}
+	assertSelfUpdateFiles(t, exe, map[string]string{"cargodrop": "build 2.0"})
+}
+
+func TestRecoverWithoutThePreviousBuild(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "cargodrop")
+	writeTestFile(t, exe, "build 2.0")
+	writeTestFile(t, exe+pendingBuildSuffix, "2.0")
+
+	if recoverExecutable(exe) {
+		t.Fatal("rolled back without a previous build")
+	}
+	assertSelfUpdateFiles(t, exe, map[string]string{"cargodrop": "build 2.0"})
+}
+
+func TestFailedBefore(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "cargodrop")
+	if failedBefore(exe, "2.0") {
+		t.Error("no record, but the version failed before")
+	}
+
+	writeTestFile(t, exe+failedBuildSuffix, "2.0\n")
+	if !failedBefore(exe, "2.0") {
+		t.Error("the version that was rolled back is installed again")
+	}
+	if failedBefore(exe, "1.9") || !failedBefore(exe, "2.0") {
+		t.Error("an older release cleared the record")
+	}
+	if failedBefore(exe, "2.1") {
+		t.Error("a newer release is skipped")
+	}
+	if failedBefore(exe, "2.0") {
+		t.Error("the record was kept after a newer release was advertised")
+	}
+}
@@ -1,17 +1,39 @@
 package workers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
 	"github.com/cosmiclabstudio/cargodrop/internal/utils"
 )
 
-// RunUpdateSequence sequence for the app to start updating stuff
-func RunUpdateSequence(config *parsers.Config, resources *parsers.ResourceSet, baseDir string, resourcePath string, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error)) {
+// UpdateOptions are the settings of an update run that come from the command line instead of the config
+type UpdateOptions struct {
+	FullVerify   bool     // ignore the hash index and hash every file again
+	Groups       []string // install exactly these optional groups, nil keeps the player's saved selection
+	Side         string   // parsers.SideClient, SideServer or SideBoth, empty is the client
+	NoSelfUpdate bool     // keep running this build even when the pack asks for a newer cargodrop
+
+	// ChooseGroups asks the player which optional groups to install, it is called when the pack has groups
+	// the player has not decided on yet and returns the selection by group name
+	ChooseGroups func(groups []parsers.Group, selected map[string]bool) map[string]bool
+	// ChangeGroups calls ChooseGroups with every group of the pack, for a player who wants to change their choice
+	ChangeGroups bool
+
+	// BeforeRestart is called right before the updater restarts itself after a self-update
+	BeforeRestart func()
+
+	// OnBackup is called with the backups folder and the files in it when files the player changed were replaced
+	OnBackup func(backupDir string, files []string)
+}
+
+// RunUpdateSequence sequence for the app to start updating stuff.
+// Failures are reported to errorCb with a message for the player and returned as well.
+func RunUpdateSequence(config *parsers.Config, resources *parsers.ResourceSet, baseDir string, resourcePath string, opts UpdateOptions, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error)) error {
 	// some introduction
 	utils.LogRaw(utils.GetFullVersionString())
 	utils.LogRaw("By using this software, you agree to the Terms of Conditions and the License of this program.")
@@ -21,73 +43,355 @@ func RunUpdateSequence(config *parsers.Config, resources *parsers.ResourceSet, b
 
 	utils.LogRaw(config.WelcomeMessage)
 
-	// Download resources.json from server
-	utils.LogMessage("Checking for updates...")
-
-	err := DownloadFile(config.UpdateServer, resourcePath, "resources.json", 0, func(fileName string, downloadedBytes, totalBytes int64) {
-		// callback
-	})
-	if err != nil {
+	// Finish or undo an update that was interrupted last time before looking at any file
+	if err := RecoverInterruptedUpdate(baseDir); err != nil {
 		utils.LogError(err)
-		errorCb("Failed to check for updates. Please check your internet connection and try again.", err)
-		return
+		errorCb("Failed to recover from an interrupted update.", err)
+		return err
 	}
 
-	// Parse the downloaded resources.json file
-	remoteSet, err := parsers.LoadResource(resourcePath)
+	selection := LoadGroupSelection(baseDir)
+	remoteSet, index, plan, err := checkForUpdates(config, resources, baseDir, stateDir(baseDir), opts, selection, errorCb)
+	var schemaErr *parsers.SchemaVersionError
+	if errors.As(err, &schemaErr) {
+		if !opts.NoSelfUpdate {
+			// the newer build the pack asks for can read it, this only returns when it could not be installed
+			selfUpdate(config, schemaErr.Updater, opts)
+		}
+		reportSchemaVersionError(err, errorCb)
+	}
 	if err != nil {
-		utils.LogError(err)
-		errorCb("Failed to parse remote resources file.", err)
-		return
+		return err
+	}
+	if err := selection.Save(); err != nil {
+		utils.LogError(fmt.Errorf("failed to save optional content selection: %v", err))
+	}
+
+	// A newer updater may understand more of the manifest, let it do the rest
+	if !opts.NoSelfUpdate {
+		selfUpdate(config, remoteSet.Updater, opts)
 	}
 
-	toUpdate := CheckResources(resources, baseDir)
-	total := len(toUpdate)
-	if total == 0 {
+	if !plan.HasChanges() {
 		utils.LogMessage("All resources are up to date.")
-		progressCb("", 0, 0, total, total)
+		progressCb("", 0, 0, 0, 0)
 	} else {
-		// Helper to find remote resource by path
-		findRemote := func(path string) *parsers.Resource {
-			for _, r := range remoteSet.Resources {
-				if r.Path == path {
-					return &r
-				}
-			}
-			return nil
-		}
+		utils.LogMessage(fmt.Sprintf("Updating from %s to %s: %d new, %d changed, %d removed.",
+			plan.FromVersion, plan.ToVersion,
+			len(plan.EntriesFor(ActionAdd)), len(plan.EntriesFor(ActionUpdate)), len(plan.EntriesFor(ActionRemove))))
 
-		for i, r := range toUpdate {
+		// Everything is downloaded into a staging area first, baseDir is only touched on commit
+		tx := newUpdateTransaction(baseDir)
+
+		installed := appliedHashes(resources)
+		var jobs []downloadJob
+		for _, entry := range append(plan.EntriesFor(ActionAdd), plan.EntriesFor(ActionUpdate)...) {
+			r := *entry.Resource
+			r.Path = entry.Path
 			filename := filepath.Base(r.Path)
-			progressCb(filename, 0, r.Size, i, total)
-			remote := findRemote(r.Path)
-			if remote == nil {
-				err := fmt.Errorf("remote resource not found for %s", r.Path)
-				utils.LogError(err)
-				errorCb("Failed to find remote resource for "+filename, err)
-				return
-			}
 
 			// Check if URL is empty
-			if remote.URL == "" {
+			if len(r.DownloadURLs()) == 0 {
 				utils.LogWarning("Unable to download " + filename + ", download URL is empty.")
 				continue // Skip this file and continue with the next one
 			}
 
-			err := DownloadFile(remote.URL, filepath.Join(baseDir, r.Path), filename, r.Size, func(fileName string, downloadedBytes, totalBytes int64) {
-				progressCb(fileName, downloadedBytes, totalBytes, i, total)
-			})
-			if err != nil {
-				utils.LogError(err)
-				errorCb("Failed to download "+filename, err)
-				return
+			tx.Add(r)
+			if entry.Action == ActionUpdate && isModifiedLocally(installed, baseDir, index, r.Path) {
+				// the player changed the file we installed, keep their version around
+				tx.Backup(r.Path)
 			}
+			if tx.IsStaged(r) {
+				utils.LogMessage(filename + " was already downloaded by a previous attempt.")
+				continue
+			}
+
+			job := downloadJob{
+				Resource:  r,
+				LocalPath: tx.StagePath(r.Path),
+			}
+
+			// Patch the installed version when the server has a cheaper way to get there
+			if entry.Action == ActionUpdate {
+				if chain := patchChainFor(remoteSet, baseDir, index, r); chain != nil {
+					job.BasePath = filepath.Join(baseDir, r.Path)
+					job.Patches = chain
+				}
+			}
+			jobs = append(jobs, job)
+		}
+
+		if config.StaleAction != parsers.StaleActionDelete {
+			tx.QuarantineRemovals()
+		}
+		for _, entry := range plan.EntriesFor(ActionRemove) {
+			utils.LogMessage("Removing " + entry.Path + ", it is no longer part of the pack.")
+			tx.Remove(entry.Path)
 		}
 
-		progressCb("", 0, 0, total, total)
+		if err := downloadAndCommit(config, tx, jobs, index, progressCb, errorCb); err != nil {
+			return err
+		}
+		if dir, files := tx.BackedUp(); len(files) > 0 && opts.OnBackup != nil {
+			opts.OnBackup(dir, files)
+		}
 		utils.LogMessage("Done!")
 	}
 
-	time.Sleep(3 * time.Second)
-	os.Exit(0)
+	if err := index.Save(); err != nil {
+		utils.LogError(fmt.Errorf("failed to save hash index: %v", err))
+	}
+
+	// Remember what was applied, the next launch diffs against it
+	if err := saveResourceSet(remoteSet, resourcePath); err != nil {
+		utils.LogError(fmt.Errorf("failed to save resources.json: %v", err))
+	}
+	return nil
+}
+
+// downloadAndCommit downloads jobs into the staging area of tx, checks them and moves everything into place
+func downloadAndCommit(config *parsers.Config, tx *updateTransaction, jobs []downloadJob, index *HashIndex, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error)) error {
+	total := len(jobs)
+	utils.LogMessage(fmt.Sprintf("Downloading %d files using up to %d connections...", total, config.MaxConcurrentDownloads))
+	progressCb("", 0, 0, 0, total)
+
+	failed, err := runDownloadPool(context.Background(), config, jobs, progressCb)
+	if err != nil {
+		utils.LogError(err)
+		errorCb("Failed to download "+filepath.Base(failed.Resource.Path), err)
+		return err
+	}
+
+	utils.LogMessage("Verifying downloaded files...")
+	if err := tx.Verify(); err != nil {
+		utils.LogError(err)
+		errorCb("Downloaded files did not match the server, nothing was changed.", err)
+		return err
+	}
+
+	utils.LogMessage("Applying update...")
+	if err := tx.Commit(); err != nil {
+		utils.LogError(err)
+		errorCb("Failed to apply the update, your previous files were restored.", err)
+		return err
+	}
+	for _, r := range tx.resources {
+		index.Record(r.Path, r.Checksum())
+	}
+	for _, path := range tx.removals {
+		index.Forget(path)
+	}
+
+	if dir, files := tx.BackedUp(); len(files) > 0 {
+		utils.LogWarning(fmt.Sprintf("%d files you changed were replaced, your versions are kept in %s", len(files), dir))
+	}
+
+	progressCb("", 0, 0, total, total)
+	return nil
+}
+
+// RunPlanSequence fetches the remote manifest and works out what an update would do, without downloading
+// or changing any file. Failures are reported to errorCb and returned.
+func RunPlanSequence(config *parsers.Config, resources *parsers.ResourceSet, baseDir string, opts UpdateOptions, errorCb func(string, error)) (*PlanSummary, error) {
+	if hasInterruptedUpdate(baseDir) {
+		utils.LogWarning("An interrupted update was found, it will be finished or undone before the next update.")
+	}
+
+	// a plan only looks, the manifest goes to a temporary folder and the selection from the command line is not saved
+	fetchDir, err := os.MkdirTemp("", "cargodrop-plan-")
+	if err != nil {
+		utils.LogError(err)
+		errorCb("Failed to check for updates.", err)
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(fetchDir) }()
+
+	remoteSet, index, plan, err := checkForUpdates(config, resources, baseDir, fetchDir, opts, LoadGroupSelection(baseDir), errorCb)
+	var schemaErr *parsers.SchemaVersionError
+	if errors.As(err, &schemaErr) {
+		reportSchemaVersionError(err, errorCb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return summarizePlan(plan, remoteSet, baseDir, index), nil
+}
+
+// checkForUpdates downloads the remote manifest into fetchDir, leaves out the optional groups that are not in selection and diffs it against baseDir.
+// A *parsers.SchemaVersionError is returned without reporting it, a self-update may still take care of it.
+func checkForUpdates(config *parsers.Config, resources *parsers.ResourceSet, baseDir, fetchDir string, opts UpdateOptions, selection *GroupSelection, errorCb func(string, error)) (*parsers.ResourceSet, *HashIndex, *UpdatePlan, error) {
+	// Download resources.json from server
+	utils.LogMessage("Checking for updates...")
+
+	remoteSet, err := fetchRemoteResourceSet(config, fetchDir)
+	var sigErr *signatureError
+	if errors.As(err, &sigErr) {
+		utils.LogError(err)
+		errorCb("The update could not be verified, it may have been tampered with.", err)
+		return nil, nil, nil, err
+	}
+	var schemaErr *parsers.SchemaVersionError
+	if errors.As(err, &schemaErr) {
+		return nil, nil, nil, err
+	}
+	var manifestErr *invalidManifestError
+	if errors.As(err, &manifestErr) {
+		utils.LogError(err)
+		errorCb("The update server sent an invalid resources.json.", err)
+		return nil, nil, nil, err
+	}
+	if err != nil {
+		utils.LogError(err)
+		errorCb("Failed to check for updates. Please check your internet connection and try again.", err)
+		return nil, nil, nil, err
+	}
+
+	if len(remoteSet.Groups) > 0 {
+		chooseGroups(remoteSet.Groups, selection, opts)
+	} else if opts.ChangeGroups {
+		utils.LogMessage("This pack has no optional content.")
+	}
+	side := opts.Side
+	if side == "" {
+		side = parsers.SideClient
+	}
+	remoteSet = selectResources(remoteSet, selection, side)
+
+	if opts.FullVerify {
+		utils.LogMessage("Full verification requested, every file will be hashed again.")
+	}
+	index := LoadHashIndex(baseDir, opts.FullVerify)
+
+	plan, err := BuildUpdatePlan(config, remoteSet, resources, baseDir, index)
+	if err != nil {
+		utils.LogError(err)
+		errorCb("Failed to compare local files with the server.", err)
+		return nil, nil, nil, err
+	}
+	return remoteSet, index, plan, nil
+}
+
+// reportSchemaVersionError tells the player the pack is too new for this build, once a self-update could not help
+func reportSchemaVersionError(err error, errorCb func(string, error)) {
+	utils.LogError(err)
+	errorCb("This pack needs a newer version of CargoDrop.", err)
+}
+
+// appliedHashes maps every path of the last applied set to the strongest hash it was installed with
+func appliedHashes(applied *parsers.ResourceSet) map[string]parsers.Checksum {
+	hashes := make(map[string]parsers.Checksum)
+	if applied == nil {
+		return hashes
+	}
+	for _, r := range applied.Resources {
+		hashes[normalizePath(r.Path)] = r.Checksum()
+	}
+	return hashes
+}
+
+// isModifiedLocally reports whether the file at path was changed after it was installed.
+// Files that were never installed by us do not count, those were not tracked to begin with.
+func isModifiedLocally(installed map[string]parsers.Checksum, baseDir string, index *HashIndex, path string) bool {
+	checksum, tracked := installed[normalizePath(path)]
+	if !tracked || checksum.IsZero() {
+		return false
+	}
+	hash, err := hashFile(index, baseDir, path, checksum.Algorithm)
+	return err == nil && hash != checksum.Value
+}
+
+// patchChainFor returns the patches that turn the installed copy of r into r, or nil when downloading
+// the full file is cheaper or there is no way to get there
+func patchChainFor(remoteSet *parsers.ResourceSet, baseDir string, index *HashIndex, r parsers.Resource) []parsers.Patches {
+	// patches are published between sha1 hashes
+	if r.Hash == "" || len(remoteSet.Patches) == 0 {
+		return nil
+	}
+	localHash, err := hashFile(index, baseDir, r.Path, utils.HashSHA1)
+	if err != nil {
+		return nil
+	}
+	chain := findPatchChain(remoteSet.Patches, r.Path, localHash, r.Hash)
+	if chain == nil || chainSize(chain) >= r.Size {
+		return nil
+	}
+	return chain
+}
+
+// fetchRemoteResourceSet downloads the resources.json published on the update server into dir and parses it
+func fetchRemoteResourceSet(config *parsers.Config, dir string) (*parsers.ResourceSet, error) {
+	remotePath := filepath.Join(dir, "remote.json")
+	err := newRetryPolicy(config).do(context.Background(), "Download of resources.json", func() error {
+		return DownloadFile(context.Background(), config.UpdateServer, remotePath, "resources.json", 0, parsers.Checksum{}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyRemoteSignature(config, dir, data); err != nil {
+		return nil, err
+	}
+
+	remoteSet, err := parsers.ParseResource(data)
+	var schemaErr *parsers.SchemaVersionError
+	if errors.As(err, &schemaErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse remote resources file: %v", err)
+	}
+
+	// a broken entry could point anywhere, none of it is used until the whole file checks out
+	problems := remoteSet.Validate()
+	problems.Log(config.UpdateServer)
+	if problems.HasErrors() {
+		return nil, &invalidManifestError{}
+	}
+	return remoteSet, nil
+}
+
+// invalidManifestError is returned when resources.json from the update server fails validation, the problems are logged
+type invalidManifestError struct{}
+
+func (e *invalidManifestError) Error() string {
+	return "resources.json from the update server is invalid, see the problems above"
+}
+
+// signatureError is returned when resources.json does not carry a valid signature of a trusted key
+type signatureError struct {
+	err error
+}
+
+func (e *signatureError) Error() string {
+	return fmt.Sprintf("resources.json is not signed by a trusted key, refusing to use it: %v", e.err)
+}
+
+// verifyRemoteSignature checks the detached signature of the downloaded resources.json against config.TrustedKeys,
+// before anything in it is looked at. Without trusted keys the pack is not signed and anything goes.
+func verifyRemoteSignature(config *parsers.Config, dir string, data []byte) error {
+	if len(config.TrustedKeys) == 0 {
+		return nil
+	}
+
+	sigPath := filepath.Join(dir, "remote.json"+parsers.SignatureSuffix)
+	err := newRetryPolicy(config).do(context.Background(), "Download of resources.json"+parsers.SignatureSuffix, func() error {
+		return DownloadFile(context.Background(), config.UpdateServer+parsers.SignatureSuffix, sigPath, "resources.json"+parsers.SignatureSuffix, 0, parsers.Checksum{}, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download the signature of resources.json: %v", err)
+	}
+	signature, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+
+	if err := parsers.VerifySignature(data, signature, config.TrustedKeys); err != nil {
+		return &signatureError{err: err}
+	}
+	utils.LogMessage("Signature of resources.json is valid.")
+	return nil
 }
@@ -0,0 +1,78 @@
+package workers
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+)
+
+func TestFetchRemoteResourceSetChecksTheSignature(t *testing.T) {
+	manifest := []byte(`{"schema_version": 2, "name": "Pack", "version": "1.0", "resources": []}`)
+	tampered := []byte(`{"schema_version": 2, "name": "Pack", "version": "6.6", "resources": []}`)
+	current := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	next := ed25519.NewKeyFromSeed([]byte("a second key of thirty-two bytes"))
+
+	tests := []struct {
+		name      string
+		served    []byte
+		signature []byte // nil when the server has no .sig
+		keys      []string
+		valid     bool
+		sigErr    bool
+	}{
+		{name: "valid", served: manifest, signature: parsers.SignData(current, manifest), keys: []string{parsers.PublicKeyOf(current)}, valid: true},
+		{name: "signed by the second trusted key", served: manifest, signature: parsers.SignData(next, manifest), keys: []string{parsers.PublicKeyOf(current), parsers.PublicKeyOf(next)}, valid: true},
+		{name: "tampered manifest", served: tampered, signature: parsers.SignData(current, manifest), keys: []string{parsers.PublicKeyOf(current)}, sigErr: true},
+		{name: "wrong key", served: manifest, signature: parsers.SignData(next, manifest), keys: []string{parsers.PublicKeyOf(current)}, sigErr: true},
+		{name: "missing signature", served: manifest, keys: []string{parsers.PublicKeyOf(current)}},
+		{name: "unsigned pack", served: manifest, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sigRequests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/resources.json":
+					_, _ = w.Write(tt.served)
+				case "/resources.json" + parsers.SignatureSuffix:
+					sigRequests.Add(1)
+					if tt.signature == nil {
+						http.NotFound(w, r)
+						return
+					}
+					_, _ = w.Write(tt.signature)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			config := &parsers.Config{UpdateServer: server.URL + "/resources.json", TrustedKeys: tt.keys}
+			remoteSet, err := fetchRemoteResourceSet(config, t.TempDir())
+
+			if tt.valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if remoteSet.LocalVersion != "1.0" {
+					t.Errorf("got version %q, want 1.0", remoteSet.LocalVersion)
+				}
+			} else if err == nil || remoteSet != nil {
+				t.Fatal("accepted the manifest, want an error")
+			}
+			var sigErr *signatureError
+			if errors.As(err, &sigErr) != tt.sigErr {
+				t.Errorf("got %v, want a signature error %v", err, tt.sigErr)
+			}
+			if len(tt.keys) == 0 && sigRequests.Load() != 0 {
+				t.Errorf("an unsigned pack asked for the signature %d times", sigRequests.Load())
+			}
+		})
+	}
+}
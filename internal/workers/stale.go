@@ -0,0 +1,143 @@
+package workers
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// normalizePath turns a manifest or local path into a forward slash path relative to baseDir,
+// so paths generated on Windows and on Linux compare equal.
+func normalizePath(path string) string {
+	return filepath.ToSlash(filepath.Clean(strings.ReplaceAll(path, "\\", "/")))
+}
+
+// isSafeFolder reports whether folder stays inside baseDir and is not baseDir itself
+func isSafeFolder(folder string) bool {
+	clean := normalizePath(folder)
+	return clean != "." && clean != ".." && !strings.HasPrefix(clean, "../") && !filepath.IsAbs(folder)
+}
+
+// skipWalkEntry reports whether a file or folder found while walking baseDir belongs to the updater itself
+func skipWalkEntry(d fs.DirEntry) bool {
+	if d.IsDir() {
+		return d.Name() == stateDirName
+	}
+	return strings.HasSuffix(d.Name(), partSuffix) || strings.HasSuffix(d.Name(), partStateSuffix)
+}
+
+// isIgnoredFile reports whether the file at localPath matches an ignore pattern of its folder in config
+func isIgnoredFile(config *parsers.Config, baseDir, localPath string) bool {
+	rel, err := filepath.Rel(baseDir, localPath)
+	return err == nil && config.IsIgnored(normalizePath(rel))
+}
+
+// policyOf returns the sync policy of r. The policy the generator stamped on it wins over the local config,
+// so the server decides how its files are treated even when players run an older config.
+func policyOf(config *parsers.Config, r parsers.Resource) string {
+	if r.Policy != "" {
+		return r.Policy
+	}
+	return config.PolicyFor(normalizePath(r.Path))
+}
+
+// neverRemoved reports whether files with the given policy are kept even when the pack drops them
+func neverRemoved(policy string) bool {
+	return policy == parsers.FolderPolicyAdditive || policy == parsers.FolderPolicySeedOnce
+}
+
+// walkFolder calls fn with the normalized path (relative to baseDir) of every file under folder,
+// leaving out the files of the updater itself. A folder that does not exist has no files.
+func walkFolder(baseDir, folder string, fn func(rel string)) error {
+	folderPath := filepath.Join(baseDir, folder)
+	if _, err := os.Stat(folderPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.WalkDir(folderPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skipWalkEntry(d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		fn(normalizePath(rel))
+		return nil
+	})
+}
+
+// FindStaleFiles returns the local files that should be removed to match rs: anything in a folder with the
+// mirror policy that is not in the manifest, plus every tombstone of rs that is still on disk.
+// Ignored files and folders that never remove anything are left alone.
+func FindStaleFiles(config *parsers.Config, rs *parsers.ResourceSet, baseDir string, index *HashIndex) ([]string, error) {
+	known := make(map[string]bool, len(rs.Resources))
+	for _, r := range rs.Resources {
+		known[normalizePath(r.Path)] = true
+	}
+
+	seen := make(map[string]bool)
+	var stale []string
+	for _, folder := range config.Folders {
+		if folder.Policy != parsers.FolderPolicyMirror {
+			continue
+		}
+		if !isSafeFolder(folder.Path) {
+			utils.LogWarning("Refusing to mirror " + folder.Path + ", mirrored folders must be inside the base directory.")
+			continue
+		}
+
+		err := walkFolder(baseDir, folder.Path, func(rel string) {
+			if config.PolicyFor(rel) != parsers.FolderPolicyMirror || config.IsIgnored(rel) {
+				// a nested folder with its own policy
+				return
+			}
+			if !known[rel] && !seen[rel] {
+				seen[rel] = true
+				stale = append(stale, rel)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tomb := range rs.Removed {
+		path := normalizePath(tomb.Path)
+		if seen[path] || known[path] || !isSafeFolder(path) {
+			continue
+		}
+		if config.IsIgnored(path) || neverRemoved(config.PolicyFor(path)) {
+			continue
+		}
+		localPath := filepath.Join(baseDir, path)
+		if _, err := os.Stat(localPath); err != nil {
+			continue
+		}
+		if tomb.Hash != "" {
+			hash, err := hashFile(index, baseDir, path, utils.HashSHA1)
+			if err != nil || hash != tomb.Hash {
+				// not the file we shipped, leave it alone
+				continue
+			}
+		}
+		seen[path] = true
+		stale = append(stale, path)
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,428 @@
+package workers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// stateDirName is the folder inside baseDir where the updater keeps its own files
+const stateDirName = ".cargodrop"
+
+const (
+	journalCommitting = "committing"
+	journalCommitted  = "committed"
+)
+
+// keptQuarantines is how many of the newest quarantine folders are kept, older ones are deleted.
+// Backups of the player's own changes are never deleted by us, only by the player.
+const keptQuarantines = 5
+
+func stateDir(baseDir string) string {
+	return filepath.Join(baseDir, stateDirName)
+}
+
+// journalEntry is one file that is being moved from staging into baseDir, or removed from it
+type journalEntry struct {
+	Path        string `json:"path"`
+	HadOriginal bool   `json:"had_original"`
+	Remove      bool   `json:"remove,omitempty"`
+	Backup      bool   `json:"backup,omitempty"` // keep the replaced file, the player changed it
+}
+
+// journal is written before the commit touches baseDir, so a crash halfway can be finished or undone
+type journal struct {
+	State      string         `json:"state"`
+	Quarantine string         `json:"quarantine,omitempty"` // where removed files end up, empty deletes them
+	Backups    string         `json:"backups,omitempty"`    // where replaced files marked for backup end up
+	Entries    []journalEntry `json:"entries"`
+}
+
+// updateTransaction downloads into a staging area and swaps the whole set into baseDir at once.
+// Files replaced during the commit are kept in a rollback folder until the commit is finished.
+type updateTransaction struct {
+	baseDir    string
+	resources  []parsers.Resource
+	removals   []string
+	quarantine string
+	backups    map[string]bool
+	backupDir  string
+	backedUp   []string
+}
+
+func newUpdateTransaction(baseDir string) *updateTransaction {
+	return &updateTransaction{baseDir: baseDir}
+}
+
+// QuarantineRemovals makes the commit move removed files to a timestamped quarantine folder instead of deleting them
+func (t *updateTransaction) QuarantineRemovals() {
+	t.quarantine = filepath.Join(stateDir(t.baseDir), "quarantine", time.Now().Format("2006-01-02_15-04-05"))
+}
+
+func (t *updateTransaction) stagingDir() string {
+	return filepath.Join(stateDir(t.baseDir), "staging")
+}
+
+func (t *updateTransaction) rollbackDir() string {
+	return filepath.Join(stateDir(t.baseDir), "rollback")
+}
+
+func (t *updateTransaction) journalPath() string {
+	return filepath.Join(stateDir(t.baseDir), "journal.json")
+}
+
+// StagePath returns where the new version of path is downloaded to
+func (t *updateTransaction) StagePath(path string) string {
+	return filepath.Join(t.stagingDir(), path)
+}
+
+// Backup makes the commit keep the file it replaces at path in a timestamped backups folder
+func (t *updateTransaction) Backup(path string) {
+	if t.backups == nil {
+		t.backups = make(map[string]bool)
+		t.backupDir = filepath.Join(stateDir(t.baseDir), "backups", time.Now().Format("2006-01-02_15-04-05"))
+	}
+	t.backups[path] = true
+}
+
+// BackedUp returns the backups folder and the files that were moved there by the commit
+func (t *updateTransaction) BackedUp() (string, []string) {
+	return t.backupDir, t.backedUp
+}
+
+// Add registers a resource that will be moved into baseDir on commit
+func (t *updateTransaction) Add(r parsers.Resource) {
+	t.resources = append(t.resources, r)
+}
+
+// Remove registers a file in baseDir that will be removed on commit
+func (t *updateTransaction) Remove(path string) {
+	t.removals = append(t.removals, path)
+}
+
+// IsStaged reports whether r is already fully downloaded from an earlier attempt
+func (t *updateTransaction) IsStaged(r parsers.Resource) bool {
+	checksum := r.Checksum()
+	if checksum.IsZero() {
+		return false
+	}
+	return verifyChecksum(t.StagePath(r.Path), checksum) == nil
+}
+
+// Verify checks every staged file against the manifest before anything is committed
+func (t *updateTransaction) Verify() error {
+	for _, r := range t.resources {
+		stagedPath := t.StagePath(r.Path)
+		info, err := os.Stat(stagedPath)
+		if err != nil {
+			return fmt.Errorf("staged file for %s is missing: %v", r.Path, err)
+		}
+		if r.Size > 0 && info.Size() != r.Size {
+			_ = os.Remove(stagedPath)
+			return fmt.Errorf("staged file for %s has size %d, expected %d", r.Path, info.Size(), r.Size)
+		}
+		checksum := r.Checksum()
+		if checksum.IsZero() {
+			continue
+		}
+		err = verifyChecksum(stagedPath, checksum)
+		var hashErr *hashMismatchError
+		if errors.As(err, &hashErr) {
+			_ = os.Remove(stagedPath)
+			return fmt.Errorf("staged file for %s has %s hash %s, expected %s", r.Path, hashErr.Algorithm, hashErr.Actual, hashErr.Expected)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit moves all staged files into baseDir. If any move fails, the previous files are put back.
+func (t *updateTransaction) Commit() error {
+	j := &journal{State: journalCommitting, Quarantine: t.quarantine, Backups: t.backupDir}
+	for _, r := range t.resources {
+		_, err := os.Stat(filepath.Join(t.baseDir, r.Path))
+		j.Entries = append(j.Entries, journalEntry{Path: r.Path, HadOriginal: err == nil, Backup: err == nil && t.backups[r.Path]})
+	}
+	for _, path := range t.removals {
+		j.Entries = append(j.Entries, journalEntry{Path: path, HadOriginal: true, Remove: true})
+	}
+	if err := t.writeJournal(j); err != nil {
+		return err
+	}
+
+	for _, entry := range j.Entries {
+		if err := t.applyEntry(entry); err != nil {
+			utils.LogError(err)
+			if rbErr := t.rollback(j); rbErr != nil {
+				return fmt.Errorf("%v (rollback also failed: %v)", err, rbErr)
+			}
+			return err
+		}
+	}
+
+	j.State = journalCommitted
+	if err := t.writeJournal(j); err != nil {
+		return err
+	}
+	return t.finish(j)
+}
+
+// applyEntry moves one staged file into place, it is safe to call again after a crash
+func (t *updateTransaction) applyEntry(entry journalEntry) error {
+	target := filepath.Join(t.baseDir, entry.Path)
+	staged := t.StagePath(entry.Path)
+	backup := filepath.Join(t.rollbackDir(), entry.Path)
+
+	if entry.Remove {
+		// removed files are parked in the rollback folder until the commit is finished
+		if _, err := os.Stat(target); err != nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			return err
+		}
+		return os.Rename(target, backup)
+	}
+
+	if _, err := os.Stat(staged); os.IsNotExist(err) {
+		// already moved into place before we were interrupted
+		return nil
+	}
+
+	if entry.HadOriginal {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(target, backup); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(staged, target)
+}
+
+// rollback restores every file touched by the journal to the state before the commit
+func (t *updateTransaction) rollback(j *journal) error {
+	utils.LogWarning("Rolling back the update...")
+	var firstErr error
+	for _, entry := range j.Entries {
+		target := filepath.Join(t.baseDir, entry.Path)
+		staged := t.StagePath(entry.Path)
+		backup := filepath.Join(t.rollbackDir(), entry.Path)
+
+		if entry.HadOriginal {
+			if _, err := os.Stat(backup); err == nil {
+				if err := os.Rename(backup, target); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+			continue
+		}
+
+		// the file is new, remove it unless it never left the staging area
+		if _, err := os.Stat(staged); os.IsNotExist(err) {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return t.cleanup()
+}
+
+// canRollForward reports whether every file of the journal can still be moved into place
+func (t *updateTransaction) canRollForward(j *journal) bool {
+	for _, entry := range j.Entries {
+		if entry.Remove {
+			continue
+		}
+		_, stagedErr := os.Stat(t.StagePath(entry.Path))
+		_, targetErr := os.Stat(filepath.Join(t.baseDir, entry.Path))
+		if stagedErr != nil && targetErr != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// finish quarantines the removed files of a committed journal, keeps the backups and cleans up after it
+func (t *updateTransaction) finish(j *journal) error {
+	if j.Backups != "" {
+		for _, entry := range j.Entries {
+			if !entry.Backup {
+				continue
+			}
+			original := filepath.Join(t.rollbackDir(), entry.Path)
+			if _, err := os.Stat(original); err != nil {
+				continue
+			}
+			dest := filepath.Join(j.Backups, entry.Path)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(original, dest); err != nil {
+				return err
+			}
+			t.backupDir = j.Backups
+			t.backedUp = append(t.backedUp, entry.Path)
+			utils.LogMessage("Backed up your version of " + entry.Path + " to " + dest)
+		}
+	}
+
+	if j.Quarantine != "" {
+		for _, entry := range j.Entries {
+			if !entry.Remove {
+				continue
+			}
+			backup := filepath.Join(t.rollbackDir(), entry.Path)
+			if _, err := os.Stat(backup); err != nil {
+				continue
+			}
+			dest := filepath.Join(j.Quarantine, entry.Path)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(backup, dest); err != nil {
+				return err
+			}
+			utils.LogMessage("Quarantined " + entry.Path + " to " + dest)
+		}
+	}
+
+	if err := pruneSnapshots(filepath.Join(stateDir(t.baseDir), "quarantine"), keptQuarantines); err != nil {
+		utils.LogWarning("Failed to clean up old quarantine folders: " + err.Error())
+	}
+	return t.cleanup()
+}
+
+// pruneSnapshots deletes all but the keep newest timestamped folders in dir
+func pruneSnapshots(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshots []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	// the folder names are timestamps, so they sort oldest first
+	sort.Strings(snapshots)
+	for len(snapshots) > keep {
+		if err := os.RemoveAll(filepath.Join(dir, snapshots[0])); err != nil {
+			return err
+		}
+		utils.LogMessage("Removed old " + filepath.Base(dir) + " folder " + snapshots[0])
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// cleanup removes the journal, rollback and staging folders after a finished commit
+func (t *updateTransaction) cleanup() error {
+	for _, dir := range []string{t.rollbackDir(), t.stagingDir()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(t.journalPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (t *updateTransaction) writeJournal(j *journal) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.journalPath(), data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path, so path is never half written
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hasInterruptedUpdate reports whether a previous update left a journal behind
+func hasInterruptedUpdate(baseDir string) bool {
+	_, err := os.Stat(newUpdateTransaction(baseDir).journalPath())
+	return err == nil
+}
+
+// RecoverInterruptedUpdate finishes or undoes a commit that was interrupted by a crash.
+// A commit is rolled forward when every staged file is still around, otherwise it is rolled back.
+func RecoverInterruptedUpdate(baseDir string) error {
+	t := newUpdateTransaction(baseDir)
+	data, err := os.ReadFile(t.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return fmt.Errorf("update journal is corrupt: %v", err)
+	}
+
+	if j.State == journalCommitted {
+		return t.finish(&j)
+	}
+
+	if t.canRollForward(&j) {
+		utils.LogWarning("Previous update was interrupted, finishing it...")
+		for _, entry := range j.Entries {
+			if err := t.applyEntry(entry); err != nil {
+				utils.LogError(err)
+				return t.rollback(&j)
+			}
+		}
+		return t.finish(&j)
+	}
+
+	utils.LogWarning("Previous update was interrupted and cannot be finished, restoring the old files...")
+	return t.rollback(&j)
+}
@@ -0,0 +1,198 @@
+package workers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertTree checks that every path of want has the given content, an empty string means the file must not exist
+func assertTree(t *testing.T, baseDir string, want map[string]string) {
+	t.Helper()
+	for path, content := range want {
+		data, err := os.ReadFile(filepath.Join(baseDir, path))
+		if content == "" {
+			if err == nil {
+				t.Errorf("%s should not exist, has %q", path, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", path, data, content)
+		}
+	}
+}
+
+// stagedUpdate sets up baseDir with an old tree and stages an update that replaces a.txt, adds b.txt and removes c.txt
+func stagedUpdate(t *testing.T) (*updateTransaction, *journal) {
+	t.Helper()
+	baseDir := t.TempDir()
+	writeTestFile(t, filepath.Join(baseDir, "a.txt"), "old a")
+	writeTestFile(t, filepath.Join(baseDir, "c.txt"), "old c")
+
+	tx := newUpdateTransaction(baseDir)
+	tx.Add(parsers.Resource{Path: "a.txt"})
+	tx.Add(parsers.Resource{Path: "sub/b.txt"})
+	tx.Remove("c.txt")
+	writeTestFile(t, tx.StagePath("a.txt"), "new a")
+	writeTestFile(t, tx.StagePath("sub/b.txt"), "new b")
+
+	// the journal as Commit writes it before touching baseDir
+	j := &journal{State: journalCommitting, Entries: []journalEntry{
+		{Path: "a.txt", HadOriginal: true},
+		{Path: "sub/b.txt"},
+		{Path: "c.txt", HadOriginal: true, Remove: true},
+	}}
+	if err := tx.writeJournal(j); err != nil {
+		t.Fatal(err)
+	}
+	return tx, j
+}
+
+var (
+	oldTree = map[string]string{"a.txt": "old a", "sub/b.txt": "", "c.txt": "old c"}
+	newTree = map[string]string{"a.txt": "new a", "sub/b.txt": "new b", "c.txt": ""}
+)
+
+func TestCommit(t *testing.T) {
+	tx, _ := stagedUpdate(t)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tx.baseDir, newTree)
+	if hasInterruptedUpdate(tx.baseDir) {
+		t.Error("journal left behind after a finished commit")
+	}
+}
+
+func TestCommitRollsBackWhenAMoveFails(t *testing.T) {
+	tx, _ := stagedUpdate(t)
+	// a file where the new file needs a folder makes the last move fail
+	tx.Add(parsers.Resource{Path: "blocked/d.txt"})
+	writeTestFile(t, tx.StagePath("blocked/d.txt"), "new d")
+	writeTestFile(t, filepath.Join(tx.baseDir, "blocked"), "keep")
+
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit below a file should fail")
+	}
+	assertTree(t, tx.baseDir, oldTree)
+	assertTree(t, tx.baseDir, map[string]string{"blocked": "keep"})
+}
+
+func TestRecoverAfterStaging(t *testing.T) {
+	tx, _ := stagedUpdate(t)
+	// interrupted before the commit moved anything, and one staged file got lost
+	if err := os.Remove(tx.StagePath("sub/b.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverInterruptedUpdate(tx.baseDir); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tx.baseDir, oldTree)
+	if hasInterruptedUpdate(tx.baseDir) {
+		t.Error("journal left behind after recovery")
+	}
+}
+
+func TestRecoverPartwayThroughCommit(t *testing.T) {
+	tests := []struct {
+		name      string
+		loseStage string // staged file that is gone after the crash, forcing a rollback
+		want      map[string]string
+	}{
+		{name: "roll forward", want: newTree},
+		{name: "roll back", loseStage: "sub/b.txt", want: oldTree},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, j := stagedUpdate(t)
+			// crash after the first file was moved into place
+			if err := tx.applyEntry(j.Entries[0]); err != nil {
+				t.Fatal(err)
+			}
+			if tt.loseStage != "" {
+				if err := os.Remove(tx.StagePath(tt.loseStage)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := RecoverInterruptedUpdate(tx.baseDir); err != nil {
+				t.Fatal(err)
+			}
+			assertTree(t, tx.baseDir, tt.want)
+			if hasInterruptedUpdate(tx.baseDir) {
+				t.Error("journal left behind after recovery")
+			}
+		})
+	}
+}
+
+func TestRecoverCommittedJournal(t *testing.T) {
+	tx, j := stagedUpdate(t)
+	tx.QuarantineRemovals()
+	j.Quarantine = tx.quarantine
+	for _, entry := range j.Entries {
+		if err := tx.applyEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// crash right after the journal was marked as committed
+	j.State = journalCommitted
+	if err := tx.writeJournal(j); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecoverInterruptedUpdate(tx.baseDir); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tx.baseDir, newTree)
+	data, err := os.ReadFile(filepath.Join(tx.quarantine, "c.txt"))
+	if err != nil || string(data) != "old c" {
+		t.Errorf("removed file was not quarantined: %q, %v", data, err)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"2024-01-03_00-00-00", "2024-01-01_00-00-00", "2024-01-04_00-00-00", "2024-01-02_00-00-00"}
+	for _, name := range names {
+		writeTestFile(t, filepath.Join(dir, name, "file.txt"), name)
+	}
+
+	if err := pruneSnapshots(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	if len(kept) != 2 || kept[0] != "2024-01-03_00-00-00" || kept[1] != "2024-01-04_00-00-00" {
+		t.Errorf("kept %v, want the two newest", kept)
+	}
+
+	if err := pruneSnapshots(filepath.Join(dir, "missing"), 2); err != nil {
+		t.Errorf("missing folder: %v", err)
+	}
+}
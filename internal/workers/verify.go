@@ -0,0 +1,172 @@
+package workers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cosmiclabstudio/cargodrop/internal/parsers"
+	"github.com/cosmiclabstudio/cargodrop/internal/utils"
+)
+
+// VerifyReport lists how the files in baseDir differ from the last applied resource set
+type VerifyReport struct {
+	Missing  []string `json:"missing"`
+	Modified []string `json:"modified"`
+	Extra    []string `json:"extra"`    // files in the tracked folders that are not part of the pack
+	Repaired []string `json:"repaired"` // broken files that were downloaded again
+	Skipped  []string `json:"skipped"`  // broken files that could not be repaired because they have no URL
+
+	BackupDir string   `json:"backup_dir,omitempty"`
+	BackedUp  []string `json:"backed_up,omitempty"` // modified files that were kept in BackupDir before the repair
+}
+
+// IsBroken reports whether a tracked file is missing or modified, extra files do not count
+func (r *VerifyReport) IsBroken() bool {
+	return len(r.Missing)+len(r.Modified) > len(r.Repaired)
+}
+
+// RunVerifySequence hashes every tracked file in baseDir against the last applied resource set, ignoring the hash index.
+// With repair, missing and modified files are downloaded again, nothing else is touched.
+// Failures are reported to errorCb and returned.
+func RunVerifySequence(config *parsers.Config, resources *parsers.ResourceSet, baseDir string, repair bool, progressCb func(fileName string, downloadedBytes, totalBytes int64, processed, total int), errorCb func(string, error)) (*VerifyReport, error) {
+	if err := RecoverInterruptedUpdate(baseDir); err != nil {
+		utils.LogError(err)
+		errorCb("Failed to recover from an interrupted update.", err)
+		return nil, err
+	}
+
+	if len(resources.Resources) == 0 {
+		utils.LogWarning("No update has been applied yet, there is nothing to verify.")
+	}
+
+	utils.LogMessage(fmt.Sprintf("Verifying %d files...", len(resources.Resources)))
+	progressCb("", 0, 0, 0, len(resources.Resources))
+
+	// a full pass, the results still refresh the index for the next launch
+	index := LoadHashIndex(baseDir, true)
+	broken := CheckResources(resources, baseDir, index)
+
+	report := &VerifyReport{
+		Missing:  []string{},
+		Modified: []string{},
+		Extra:    []string{},
+		Repaired: []string{},
+		Skipped:  []string{},
+	}
+	var needsRepair []parsers.Resource
+	for _, r := range broken {
+		path := normalizePath(r.Path)
+		if config.IsIgnored(path) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, path)); os.IsNotExist(err) {
+			report.Missing = append(report.Missing, path)
+		} else if policyOf(config, r) == parsers.FolderPolicySeedOnce {
+			// seeded files are the player's to change
+			continue
+		} else {
+			report.Modified = append(report.Modified, path)
+		}
+		needsRepair = append(needsRepair, r)
+	}
+
+	extra, err := findUntrackedFiles(config, resources, baseDir)
+	if err != nil {
+		utils.LogError(err)
+		errorCb("Failed to scan the game folders.", err)
+		return nil, err
+	}
+	report.Extra = extra
+	progressCb("", 0, 0, len(resources.Resources), len(resources.Resources))
+
+	for _, path := range report.Missing {
+		utils.LogWarning("Missing: " + path)
+	}
+	for _, path := range report.Modified {
+		utils.LogWarning("Modified: " + path)
+	}
+	for _, path := range report.Extra {
+		utils.LogMessage("Not part of the pack: " + path)
+	}
+	utils.LogMessage(fmt.Sprintf("%d missing, %d modified, %d extra files.", len(report.Missing), len(report.Modified), len(report.Extra)))
+
+	if repair && len(needsRepair) > 0 {
+		utils.LogMessage(fmt.Sprintf("Repairing %d files...", len(needsRepair)))
+
+		tx := newUpdateTransaction(baseDir)
+		var jobs []downloadJob
+		for _, r := range needsRepair {
+			r.Path = normalizePath(r.Path)
+			if len(r.DownloadURLs()) == 0 {
+				utils.LogWarning("Unable to repair " + r.Path + ", download URL is empty.")
+				report.Skipped = append(report.Skipped, r.Path)
+				continue
+			}
+
+			tx.Add(r)
+			if _, err := os.Stat(filepath.Join(baseDir, r.Path)); err == nil {
+				// whatever is there now might be a change the player wants to keep
+				tx.Backup(r.Path)
+			}
+			if !tx.IsStaged(r) {
+				jobs = append(jobs, downloadJob{Resource: r, LocalPath: tx.StagePath(r.Path)})
+			}
+		}
+
+		if err := downloadAndCommit(config, tx, jobs, index, progressCb, errorCb); err != nil {
+			return nil, err
+		}
+		for _, r := range tx.resources {
+			report.Repaired = append(report.Repaired, r.Path)
+		}
+		if dir, files := tx.BackedUp(); len(files) > 0 {
+			report.BackupDir, report.BackedUp = dir, files
+		}
+		sort.Strings(report.Repaired)
+		utils.LogMessage(fmt.Sprintf("Repaired %d files.", len(report.Repaired)))
+	}
+
+	if err := index.Save(); err != nil {
+		utils.LogError(fmt.Errorf("failed to save hash index: %v", err))
+	}
+
+	if report.IsBroken() {
+		utils.LogWarning("Some files are still broken, run a repair or report this issue to your server administrator.")
+	} else {
+		utils.LogMessage("All files are intact.")
+	}
+	return report, nil
+}
+
+// findUntrackedFiles returns the files under config.Folders that are not listed in rs, sorted
+func findUntrackedFiles(config *parsers.Config, rs *parsers.ResourceSet, baseDir string) ([]string, error) {
+	known := make(map[string]bool, len(rs.Resources))
+	for _, r := range rs.Resources {
+		known[normalizePath(r.Path)] = true
+	}
+
+	seen := make(map[string]bool)
+	extra := []string{}
+	for _, folder := range config.Folders {
+		if !isSafeFolder(folder.Path) {
+			continue
+		}
+		err := walkFolder(baseDir, folder.Path, func(rel string) {
+			if config.IsIgnored(rel) {
+				return
+			}
+			if !known[rel] && !seen[rel] {
+				seen[rel] = true
+				extra = append(extra, rel)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(extra)
+	return extra, nil
+}